@@ -2,6 +2,8 @@ package config
 
 import (
 	"os"
+	"strconv"
+	"time"
 
 	"github.com/joho/godotenv"
 )
@@ -13,17 +15,52 @@ type Config struct {
 	InternalSecret      string
 	ProjectRoot         string
 	DatabaseUrl         string
+	UploadPolicies      map[string]*UploadPolicy
+	ImageProcessor      string // "imgproxy" or "vips"
+	PendingStore        string // "memory" or "postgres", where uploads wait to be verified
+	MetadataKeep        string // comma separated tags kept when stripping metadata: "orientation", "icc"
+	ScannerAddress      string // clamd socket, e.g. "unix:///run/clamav/clamd.ctl" or "tcp://127.0.0.1:3310"
+	ScannerFailOpen     bool
+	ProxyMaxPixels      int64 // largest frame, width*height, GetImageDimensions and the vips ServeLocal will load
+	ProxyMaxFrames      int
+	// ReadTimeout covers the whole request, a streamed upload body included, unless the stall watchdog
+	// is enabled, which moves the read deadline forward while the body arrives. WriteTimeout covers the
+	// whole response, so it also cuts off slow downloads of large files. Both are unset (zero) by default.
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+	IdleTimeout  time.Duration
+	// Upload bodies are aborted when they arrive slower than UploadMinBytesPerSecond over UploadStallWindow.
+	// A zero rate or window disables the watchdog.
+	UploadMinBytesPerSecond int64
+	UploadStallWindow       time.Duration
+	VideoRemuxTimeout       time.Duration // zero disables the remux of uploaded videos
+	QuarantineMaxAge        time.Duration // how long interrupted writes are kept in quarantine/, zero keeps them
 }
 
 func LoadConfig() *Config {
 	_ = godotenv.Load()
 
 	config := &Config{
-		Port:                getEnv("PORT", "3000"),
-		ExternalEmbedSecret: getEnv("EXTERNAL_EMBED_SECRET", ""),
-		JwtSecret:           getEnv("JWT_SECRET", ""),
-		InternalSecret:      getEnv("INTERNAL_SECRET", ""),
-		DatabaseUrl:         getEnv("DATABASE_URL", ""),
+		Port:                    getEnv("PORT", "3000"),
+		ExternalEmbedSecret:     getEnv("EXTERNAL_EMBED_SECRET", ""),
+		JwtSecret:               getEnv("JWT_SECRET", ""),
+		InternalSecret:          getEnv("INTERNAL_SECRET", ""),
+		DatabaseUrl:             getEnv("DATABASE_URL", ""),
+		UploadPolicies:          loadUploadPolicies(getEnv("UPLOAD_POLICIES_FILE", "upload-policies.json")),
+		ImageProcessor:          getEnv("IMAGE_PROCESSOR", "imgproxy"),
+		PendingStore:            getEnv("PENDING_STORE", "memory"),
+		MetadataKeep:            getEnv("METADATA_KEEP", "orientation,icc"),
+		ScannerAddress:          getEnv("SCANNER_ADDRESS", ""),
+		ScannerFailOpen:         getEnv("SCANNER_FAIL_OPEN", "false") == "true",
+		ProxyMaxPixels:          int64(getEnvInt("PROXY_MAX_PIXELS", 50_000_000)),
+		ProxyMaxFrames:          getEnvInt("PROXY_MAX_FRAMES", 1000),
+		ReadTimeout:             time.Duration(getEnvInt("READ_TIMEOUT_SECONDS", 0)) * time.Second,
+		WriteTimeout:            time.Duration(getEnvInt("WRITE_TIMEOUT_SECONDS", 0)) * time.Second,
+		IdleTimeout:             time.Duration(getEnvInt("IDLE_TIMEOUT_SECONDS", 120)) * time.Second,
+		UploadMinBytesPerSecond: int64(getEnvInt("UPLOAD_MIN_BYTES_PER_SECOND", 4096)),
+		UploadStallWindow:       time.Duration(getEnvInt("UPLOAD_STALL_WINDOW_SECONDS", 30)) * time.Second,
+		VideoRemuxTimeout:       time.Duration(getEnvInt("VIDEO_REMUX_TIMEOUT_SECONDS", 120)) * time.Second,
+		QuarantineMaxAge:        time.Duration(getEnvInt("QUARANTINE_MAX_AGE_HOURS", 7*24)) * time.Hour,
 	}
 
 	if config.ExternalEmbedSecret == "" {
@@ -40,9 +77,26 @@ func LoadConfig() *Config {
 	return config
 }
 
+func (c *Config) UploadPolicy(category string) *UploadPolicy {
+	return c.UploadPolicies[category]
+}
+
 func getEnv(key, fallback string) string {
 	if value, ok := os.LookupEnv(key); ok {
 		return value
 	}
 	return fallback
 }
+
+func getEnvInt(key string, fallback int) int {
+	value, ok := os.LookupEnv(key)
+	if !ok {
+		return fallback
+	}
+	parsed, err := strconv.Atoi(value)
+	if err != nil {
+		println(key + " is not a number, using " + strconv.Itoa(fallback))
+		return fallback
+	}
+	return parsed
+}
@@ -0,0 +1,163 @@
+package config
+
+import (
+	"encoding/json"
+	"os"
+	"slices"
+	"time"
+)
+
+type UploadPolicy struct {
+	// MaxBytes is the largest upload accepted for the category.
+	MaxBytes int64 `json:"maxBytes"`
+	// AllowedMimeTypes limits which detected types may be uploaded, empty allows anything.
+	AllowedMimeTypes []string `json:"allowedMimeTypes"`
+	Width            int      `json:"width"`
+	Height           int      `json:"height"`
+	// ResizeMode is either "fit" or "fill".
+	ResizeMode    string `json:"resizeMode"`
+	AllowAnimated bool   `json:"allowAnimated"`
+	// CompressMaxBytes is the largest image that is still sent through compression.
+	CompressMaxBytes int64 `json:"compressMaxBytes"`
+	// MaxPixels limits width*height of a single frame and MaxFrames the number of frames,
+	// both are read from the image header before anything is decoded.
+	MaxPixels int64           `json:"maxPixels"`
+	MaxFrames int             `json:"maxFrames"`
+	RateLimit UploadRateLimit `json:"rateLimit"`
+	// An upload waits PendingTtlSeconds to be verified, extending it moves the deadline again
+	// but never past PendingMaxLifetimeSeconds after the upload.
+	PendingTtlSeconds         int `json:"pendingTtlSeconds"`
+	PendingMaxLifetimeSeconds int `json:"pendingMaxLifetimeSeconds"`
+}
+
+// UploadRateLimit applies separately to every user and every client IP, zero disables a limit.
+type UploadRateLimit struct {
+	Requests      int   `json:"requests"`
+	Bytes         int64 `json:"bytes"`
+	WindowSeconds int   `json:"windowSeconds"`
+	Concurrent    int   `json:"concurrent"`
+}
+
+func (p *UploadPolicy) AllowsMimeType(mime string) bool {
+	if len(p.AllowedMimeTypes) == 0 {
+		return true
+	}
+	return slices.Contains(p.AllowedMimeTypes, mime)
+}
+
+// PendingTTL defaults to one minute when the policy doesn't set it.
+func (p *UploadPolicy) PendingTTL() time.Duration {
+	if p.PendingTtlSeconds <= 0 {
+		return time.Minute
+	}
+	return time.Duration(p.PendingTtlSeconds) * time.Second
+}
+
+func (p *UploadPolicy) PendingMaxLifetime() time.Duration {
+	return max(time.Duration(p.PendingMaxLifetimeSeconds)*time.Second, p.PendingTTL())
+}
+
+var imageMimeTypes = []string{
+	"image/webp", "image/png", "image/jpeg", "image/jpg", "image/gif",
+	"image/heic", "image/heif", "image/avif", "image/jxl",
+}
+
+func defaultUploadPolicies() map[string]*UploadPolicy {
+	return map[string]*UploadPolicy{
+		"attachments": {
+			MaxBytes:                  50 * 1024 * 1024,
+			Width:                     1920,
+			Height:                    1080,
+			ResizeMode:                "fit",
+			AllowAnimated:             true,
+			CompressMaxBytes:          12 * 1024 * 1024,
+			MaxPixels:                 50_000_000,
+			MaxFrames:                 1000,
+			RateLimit:                 UploadRateLimit{Requests: 60, Bytes: 500 * 1024 * 1024, WindowSeconds: 60, Concurrent: 5},
+			PendingTtlSeconds:         60,
+			PendingMaxLifetimeSeconds: 60 * 60,
+		},
+		"emojis": {
+			MaxBytes:                  12 * 1024 * 1024,
+			AllowedMimeTypes:          slices.Clone(imageMimeTypes),
+			Width:                     100,
+			Height:                    100,
+			ResizeMode:                "fit",
+			AllowAnimated:             true,
+			CompressMaxBytes:          12 * 1024 * 1024,
+			MaxPixels:                 4096 * 4096,
+			MaxFrames:                 300,
+			RateLimit:                 UploadRateLimit{Requests: 20, Bytes: 100 * 1024 * 1024, WindowSeconds: 60, Concurrent: 2},
+			PendingTtlSeconds:         60,
+			PendingMaxLifetimeSeconds: 10 * 60,
+		},
+		"avatars": {
+			MaxBytes:                  12 * 1024 * 1024,
+			AllowedMimeTypes:          slices.Clone(imageMimeTypes),
+			Width:                     200,
+			Height:                    200,
+			ResizeMode:                "fill",
+			AllowAnimated:             true,
+			CompressMaxBytes:          12 * 1024 * 1024,
+			MaxPixels:                 25_000_000,
+			MaxFrames:                 500,
+			RateLimit:                 UploadRateLimit{Requests: 20, Bytes: 100 * 1024 * 1024, WindowSeconds: 60, Concurrent: 2},
+			PendingTtlSeconds:         60,
+			PendingMaxLifetimeSeconds: 10 * 60,
+		},
+		"profile_banners": {
+			MaxBytes:                  12 * 1024 * 1024,
+			AllowedMimeTypes:          slices.Clone(imageMimeTypes),
+			Width:                     1920,
+			Height:                    1080,
+			ResizeMode:                "fill",
+			AllowAnimated:             true,
+			CompressMaxBytes:          12 * 1024 * 1024,
+			MaxPixels:                 40_000_000,
+			MaxFrames:                 500,
+			RateLimit:                 UploadRateLimit{Requests: 20, Bytes: 100 * 1024 * 1024, WindowSeconds: 60, Concurrent: 2},
+			PendingTtlSeconds:         60,
+			PendingMaxLifetimeSeconds: 10 * 60,
+		},
+	}
+}
+
+// loadUploadPolicies reads per category overrides from a JSON file, e.g.
+// {"emojis": {"maxBytes": 5242880, "allowAnimated": false}}
+// Fields that are left out keep their default value.
+func loadUploadPolicies(path string) map[string]*UploadPolicy {
+	policies := defaultUploadPolicies()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			println("Failed to read upload policies from " + path + ": " + err.Error())
+		}
+		return policies
+	}
+
+	var overrides map[string]json.RawMessage
+	if err := json.Unmarshal(data, &overrides); err != nil {
+		println("Invalid upload policies in " + path + ": " + err.Error())
+		return policies
+	}
+
+	for category, raw := range overrides {
+		policy, ok := policies[category]
+		if !ok {
+			println("Unknown upload policy category: " + category)
+			continue
+		}
+		// Decoded into a copy so an override that fails halfway doesn't leave a half applied policy.
+		// json.Unmarshal reuses the backing array of slices, so those are copied too.
+		override := *policy
+		override.AllowedMimeTypes = slices.Clone(policy.AllowedMimeTypes)
+		if err := json.Unmarshal(raw, &override); err != nil {
+			println("Invalid upload policy for " + category + ", keeping the defaults: " + err.Error())
+			continue
+		}
+		policies[category] = &override
+	}
+
+	return policies
+}
@@ -0,0 +1,97 @@
+package database
+
+import (
+	"cdn_nerimity_go/security"
+	"context"
+	"errors"
+
+	"github.com/jackc/pgx/v5"
+)
+
+const uploadCredentialColumns = `"id", "userId", "name", "categories", "groupIds",
+	"rateLimitRequests", "rateLimitBytes", "rateLimitWindowSeconds", "rateLimitConcurrent", "createdAt"`
+
+func (h *DatabaseService) CreateUploadCredential(credential *security.UploadCredential, tokenHash string) error {
+	query := `
+		INSERT INTO "UploadCredential" ("id", "tokenHash", "userId", "name", "categories", "groupIds",
+			"rateLimitRequests", "rateLimitBytes", "rateLimitWindowSeconds", "rateLimitConcurrent")
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+		RETURNING "createdAt"`
+
+	rateLimit := credential.RateLimit
+	return h.pool.QueryRow(context.Background(), query,
+		credential.Id, tokenHash, credential.UserId, credential.Name, credential.Categories, credential.GroupIds,
+		rateLimit.Requests, rateLimit.Bytes, rateLimit.WindowSeconds, rateLimit.Concurrent,
+	).Scan(&credential.CreatedAt)
+}
+
+// GetUploadCredential returns the credential stored under tokenHash, or nil when there is none or it was revoked.
+func (h *DatabaseService) GetUploadCredential(tokenHash string) (*security.UploadCredential, error) {
+	query := `
+		SELECT ` + uploadCredentialColumns + `
+		FROM "UploadCredential"
+		WHERE "tokenHash" = $1 AND "revokedAt" IS NULL`
+
+	credential, err := scanUploadCredential(h.pool.QueryRow(context.Background(), query, tokenHash))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, nil
+	}
+	return credential, err
+}
+
+// ListUploadCredentials returns the credentials of a user that have not been revoked.
+func (h *DatabaseService) ListUploadCredentials(userId string) ([]*security.UploadCredential, error) {
+	query := `
+		SELECT ` + uploadCredentialColumns + `
+		FROM "UploadCredential"
+		WHERE "userId" = $1 AND "revokedAt" IS NULL
+		ORDER BY "createdAt"`
+
+	rows, err := h.pool.Query(context.Background(), query, userId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	credentials := []*security.UploadCredential{}
+	for rows.Next() {
+		credential, err := scanUploadCredential(rows)
+		if err != nil {
+			return nil, err
+		}
+		credentials = append(credentials, credential)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return credentials, nil
+}
+
+// RevokeUploadCredential reports false when there was no credential left to revoke.
+func (h *DatabaseService) RevokeUploadCredential(id string) (bool, error) {
+	query := `
+		UPDATE "UploadCredential"
+		SET "revokedAt" = NOW()
+		WHERE "id" = $1 AND "revokedAt" IS NULL`
+
+	tag, err := h.pool.Exec(context.Background(), query, id)
+	if err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() > 0, nil
+}
+
+func scanUploadCredential(row pgx.Row) (*security.UploadCredential, error) {
+	credential := &security.UploadCredential{}
+	rateLimit := &credential.RateLimit
+	err := row.Scan(
+		&credential.Id, &credential.UserId, &credential.Name, &credential.Categories, &credential.GroupIds,
+		&rateLimit.Requests, &rateLimit.Bytes, &rateLimit.WindowSeconds, &rateLimit.Concurrent, &credential.CreatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return credential, nil
+}
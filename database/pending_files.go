@@ -0,0 +1,221 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// PendingFileRecord is an uploaded file waiting to be verified.
+// Data holds the rest of the file's details as JSON, only the columns that are queried on are split out.
+type PendingFileRecord struct {
+	FileId    int64
+	UserId    int64
+	GroupId   int64
+	Category  string
+	Path      string
+	Data      []byte
+	ExpiresAt time.Time
+}
+
+const pendingFileColumns = `"fileId", "userId", "groupId", "category", "path", "data", "expiresAt"`
+
+func (h *DatabaseService) AddPendingFile(record *PendingFileRecord) error {
+	query := `
+		INSERT INTO "PendingFile" (` + pendingFileColumns + `)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)`
+
+	_, err := h.pool.Exec(context.Background(), query,
+		strconv.FormatInt(record.FileId, 10), strconv.FormatInt(record.UserId, 10), strconv.FormatInt(record.GroupId, 10),
+		record.Category, record.Path, record.Data, record.ExpiresAt,
+	)
+	return err
+}
+
+// TakePendingFile deletes a pending file and returns it, or nil when there is none.
+// Deleting and reading in one statement makes sure a file is only ever verified once, whichever instance asks.
+func (h *DatabaseService) TakePendingFile(fileId int64) (*PendingFileRecord, error) {
+	query := `
+		DELETE FROM "PendingFile"
+		WHERE "fileId" = $1
+		RETURNING ` + pendingFileColumns
+
+	record, err := scanPendingFile(h.pool.QueryRow(context.Background(), query, strconv.FormatInt(fileId, 10)))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, nil
+	}
+	return record, err
+}
+
+// GetPendingFile returns a pending file, or nil when there is none.
+func (h *DatabaseService) GetPendingFile(fileId int64) (*PendingFileRecord, error) {
+	query := `
+		SELECT ` + pendingFileColumns + `
+		FROM "PendingFile"
+		WHERE "fileId" = $1`
+
+	record, err := scanPendingFile(h.pool.QueryRow(context.Background(), query, strconv.FormatInt(fileId, 10)))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, nil
+	}
+	return record, err
+}
+
+// ExtendPendingFile reports false when there was no pending file left to extend.
+func (h *DatabaseService) ExtendPendingFile(fileId int64, expiresAt time.Time) (bool, error) {
+	query := `
+		UPDATE "PendingFile"
+		SET "expiresAt" = $2
+		WHERE "fileId" = $1 AND "expiresAt" > $3`
+
+	tag, err := h.pool.Exec(context.Background(), query, strconv.FormatInt(fileId, 10), expiresAt, time.Now())
+	if err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() > 0, nil
+}
+
+// DeleteExpiredPendingFiles deletes up to 100 expired pending files and returns them, so their files can be removed.
+func (h *DatabaseService) DeleteExpiredPendingFiles() ([]*PendingFileRecord, error) {
+	query := `
+		DELETE FROM "PendingFile"
+		WHERE "fileId" IN (
+			SELECT "fileId" FROM "PendingFile"
+			WHERE "expiresAt" <= $1
+			LIMIT 100
+		)
+		RETURNING ` + pendingFileColumns
+
+	// Expiry times are written by the application, so they are compared against its clock as well.
+	rows, err := h.pool.Query(context.Background(), query, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var records []*PendingFileRecord
+	for rows.Next() {
+		record, err := scanPendingFile(rows)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, record)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return records, nil
+}
+
+// PendingFileFilter matches every pending file when left empty, Limit is only used when listing.
+type PendingFileFilter struct {
+	UserId   int64
+	GroupId  int64
+	Category string
+	Limit    int
+}
+
+func (f PendingFileFilter) where() (string, []any) {
+	var userId, groupId string
+	if f.UserId != 0 {
+		userId = strconv.FormatInt(f.UserId, 10)
+	}
+	if f.GroupId != 0 {
+		groupId = strconv.FormatInt(f.GroupId, 10)
+	}
+
+	where := `
+		WHERE ($1 = '' OR "userId" = $1)
+		AND ($2 = '' OR "groupId" = $2)
+		AND ($3 = '' OR "category" = $3)`
+	return where, []any{userId, groupId, f.Category}
+}
+
+// ListPendingFiles returns the oldest pending files matching filter.
+func (h *DatabaseService) ListPendingFiles(filter PendingFileFilter) ([]*PendingFileRecord, error) {
+	where, args := filter.where()
+	query := `
+		SELECT ` + pendingFileColumns + `
+		FROM "PendingFile"` + where + `
+		ORDER BY "createdAt"
+		LIMIT NULLIF($4, 0)`
+
+	rows, err := h.pool.Query(context.Background(), query, append(args, filter.Limit)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	records := []*PendingFileRecord{}
+	for rows.Next() {
+		record, err := scanPendingFile(rows)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, record)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return records, nil
+}
+
+// CountPendingFiles returns how many pending files match filter and their size in bytes.
+func (h *DatabaseService) CountPendingFiles(filter PendingFileFilter) (int, int64, error) {
+	where, args := filter.where()
+	query := `
+		SELECT COUNT(*), COALESCE(SUM(("data"->>'FileSize')::BIGINT), 0)
+		FROM "PendingFile"` + where
+
+	var count int
+	var bytes int64
+	err := h.pool.QueryRow(context.Background(), query, args...).Scan(&count, &bytes)
+	return count, bytes, err
+}
+
+// GetPendingFilePaths returns which of paths still belong to a pending file.
+func (h *DatabaseService) GetPendingFilePaths(paths []string) (map[string]bool, error) {
+	query := `SELECT "path" FROM "PendingFile" WHERE "path" = ANY($1)`
+
+	rows, err := h.pool.Query(context.Background(), query, paths)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	found := make(map[string]bool)
+	for rows.Next() {
+		var path string
+		if err := rows.Scan(&path); err != nil {
+			return nil, err
+		}
+		found[path] = true
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return found, nil
+}
+
+func scanPendingFile(row pgx.Row) (*PendingFileRecord, error) {
+	var strFileId, strUserId, strGroupId string
+	record := &PendingFileRecord{}
+	err := row.Scan(&strFileId, &strUserId, &strGroupId, &record.Category, &record.Path, &record.Data, &record.ExpiresAt)
+	if err != nil {
+		return nil, err
+	}
+
+	record.FileId, _ = strconv.ParseInt(strFileId, 10, 64)
+	record.UserId, _ = strconv.ParseInt(strUserId, 10, 64)
+	record.GroupId, _ = strconv.ParseInt(strGroupId, 10, 64)
+	return record, nil
+}
@@ -0,0 +1,108 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// newTestDatabase runs the pending file migration in a throwaway schema of TEST_DATABASE_URL.
+func newTestDatabase(t *testing.T) *DatabaseService {
+	t.Helper()
+
+	databaseUrl := os.Getenv("TEST_DATABASE_URL")
+	if databaseUrl == "" {
+		t.Skip("TEST_DATABASE_URL is not set")
+	}
+
+	migration, err := os.ReadFile("../migrations/03-pending-files.sql")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	conn, err := pgx.Connect(ctx, databaseUrl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close(ctx)
+
+	schema := fmt.Sprintf("pending_test_%d", time.Now().UnixNano())
+	if _, err := conn.Exec(ctx, `CREATE SCHEMA `+schema); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		conn, err := pgx.Connect(context.Background(), databaseUrl)
+		if err != nil {
+			return
+		}
+		defer conn.Close(context.Background())
+		conn.Exec(context.Background(), `DROP SCHEMA `+schema+` CASCADE`)
+	})
+	if _, err := conn.Exec(ctx, `SET search_path TO `+schema+`; `+string(migration)); err != nil {
+		t.Fatal(err)
+	}
+
+	parsed, err := url.Parse(databaseUrl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := parsed.Query()
+	query.Set("search_path", schema)
+	parsed.RawQuery = query.Encode()
+
+	db := NewDatabaseService(parsed.String())
+	t.Cleanup(db.pool.Close)
+	return db
+}
+
+// The expiry is compared against the application's clock, which must not depend on the host's time zone.
+func TestPendingFileExpiryOutsideUTC(t *testing.T) {
+	local := time.Local
+	time.Local = time.FixedZone("UTC+10", 10*60*60)
+	t.Cleanup(func() { time.Local = local })
+
+	db := newTestDatabase(t)
+
+	expiresAt := time.Now().Add(30 * time.Minute).Truncate(time.Millisecond)
+	record := &PendingFileRecord{FileId: 1, UserId: 2, GroupId: 3, Category: "attachments", Path: "temp/1", Data: []byte("{}"), ExpiresAt: expiresAt}
+	if err := db.AddPendingFile(record); err != nil {
+		t.Fatal(err)
+	}
+	expired := &PendingFileRecord{FileId: 4, UserId: 2, GroupId: 3, Category: "attachments", Path: "temp/4", Data: []byte("{}"), ExpiresAt: time.Now().Add(-time.Minute)}
+	if err := db.AddPendingFile(expired); err != nil {
+		t.Fatal(err)
+	}
+
+	stored, err := db.GetPendingFile(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored == nil {
+		t.Fatal("pending file was not stored")
+	}
+	if !stored.ExpiresAt.Equal(expiresAt) {
+		t.Fatalf("stored expiry = %v, want %v", stored.ExpiresAt, expiresAt)
+	}
+
+	deleted, err := db.DeleteExpiredPendingFiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deleted) != 1 || deleted[0].FileId != 4 {
+		t.Fatalf("deleted %d files, want only file 4", len(deleted))
+	}
+
+	extended, err := db.ExtendPendingFile(1, expiresAt.Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !extended {
+		t.Error("ExtendPendingFile reported the file as expired")
+	}
+}
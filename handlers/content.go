@@ -18,11 +18,11 @@ import (
 	"cdn_nerimity_go/utils"
 
 	"github.com/gofiber/fiber/v3"
-	"github.com/gofiber/fiber/v3/middleware/proxy"
 )
 
 type ContentHandler struct {
-	Env *config.Config
+	Env            *config.Config
+	ImageProcessor utils.ImageProcessor
 }
 
 var thumbMutexes sync.Map
@@ -69,7 +69,7 @@ func (h *ContentHandler) GetContent(c fiber.Ctx) error {
 	}
 
 	if shouldProxyImage(c, finalPath, info.Size()) {
-		return handleProxyImage(c, finalPath)
+		return handleProxyImage(c, h, finalPath)
 	}
 
 	return serveFile(c, finalPath)
@@ -193,7 +193,7 @@ func deleteStaleThumbnail(path string, maxAge time.Duration) error {
 	return nil
 }
 
-func handleProxyImage(c fiber.Ctx, finalPath string) error {
+func handleProxyImage(c fiber.Ctx, h *ContentHandler, finalPath string) error {
 	imageType := c.Query("type")
 	size := c.Query("size")
 	var static = imageType == "webp"
@@ -201,9 +201,9 @@ func handleProxyImage(c fiber.Ctx, finalPath string) error {
 	if size != "" {
 		parsedSize, _ = strconv.Atoi(size)
 	}
-	var proxyURL = utils.GenerateBasicImageProxyURL(utils.BasicImageProxyOptions{URL: finalPath, IsLocalURL: true, Static: static, Size: parsedSize})
+	var opts = utils.BasicImageProxyOptions{URL: finalPath, IsLocalURL: true, Static: static, Size: parsedSize}
 
-	if err := proxy.Do(c, proxyURL); err != nil {
+	if err := h.ImageProcessor.ServeLocal(c, opts); err != nil {
 		return err
 	}
 
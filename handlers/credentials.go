@@ -0,0 +1,136 @@
+package handlers
+
+import (
+	"cdn_nerimity_go/config"
+	"cdn_nerimity_go/security"
+	"cdn_nerimity_go/utils"
+	"log"
+	"strconv"
+
+	"github.com/gofiber/fiber/v3"
+)
+
+type CreateCredentialRequest struct {
+	UserId     string                 `json:"userId"`
+	Name       string                 `json:"name"`
+	Categories []string               `json:"categories"`
+	GroupIds   []string               `json:"groupIds"`
+	RateLimit  config.UploadRateLimit `json:"rateLimit"`
+}
+
+// CreateCredential creates an upload credential for a bot or webhook.
+// The token is only returned here, the database only keeps its hash.
+func (h *InternalHandler) CreateCredential(c fiber.Ctx) error {
+	authHeader := c.Get("Authorization")
+
+	if authHeader != h.Env.InternalSecret {
+		return utils.SendError(c, fiber.StatusUnauthorized, "Unauthorized")
+	}
+	body := new(CreateCredentialRequest)
+
+	if err := c.Bind().Body(body); err != nil {
+		return err
+	}
+
+	if _, err := strconv.ParseInt(body.UserId, 10, 64); err != nil {
+		return utils.SendError(c, fiber.StatusBadRequest, "Invalid user Id")
+	}
+	if len(body.Categories) == 0 {
+		return utils.SendError(c, fiber.StatusBadRequest, "Missing categories")
+	}
+	for _, category := range body.Categories {
+		if h.Env.UploadPolicy(category) == nil {
+			return utils.SendError(c, fiber.StatusBadRequest, "Invalid category")
+		}
+	}
+	if body.GroupIds == nil {
+		body.GroupIds = []string{}
+	}
+	for _, groupId := range body.GroupIds {
+		if _, err := strconv.ParseInt(groupId, 10, 64); err != nil {
+			return utils.SendError(c, fiber.StatusBadRequest, "Invalid group Id")
+		}
+	}
+
+	token, tokenHash, err := security.GenerateCredentialToken()
+	if err != nil {
+		return utils.SendError(c, fiber.StatusInternalServerError, "Failed to generate token")
+	}
+
+	credential := &security.UploadCredential{
+		Id:         strconv.FormatInt(h.Flake.Generate(), 10),
+		UserId:     body.UserId,
+		Name:       body.Name,
+		Categories: body.Categories,
+		GroupIds:   body.GroupIds,
+		RateLimit:  body.RateLimit,
+	}
+	err = h.Database.CreateUploadCredential(credential, tokenHash)
+	if err != nil {
+		log.Println(err)
+		return utils.SendError(c, fiber.StatusInternalServerError, "Failed to create credential")
+	}
+
+	json := credentialJSON(credential)
+	json["token"] = token
+	return c.JSON(json)
+}
+
+func (h *InternalHandler) ListCredentials(c fiber.Ctx) error {
+	authHeader := c.Get("Authorization")
+
+	if authHeader != h.Env.InternalSecret {
+		return utils.SendError(c, fiber.StatusUnauthorized, "Unauthorized")
+	}
+
+	userId := c.Query("userId")
+	if _, err := strconv.ParseInt(userId, 10, 64); err != nil {
+		return utils.SendError(c, fiber.StatusBadRequest, "Invalid user Id")
+	}
+
+	credentials, err := h.Database.ListUploadCredentials(userId)
+	if err != nil {
+		log.Println(err)
+		return utils.SendError(c, fiber.StatusInternalServerError, "Failed to list credentials")
+	}
+
+	json := make([]fiber.Map, 0, len(credentials))
+	for _, credential := range credentials {
+		json = append(json, credentialJSON(credential))
+	}
+	return c.JSON(json)
+}
+
+// RevokeCredential stops a credential from being accepted, uploads already in progress are not affected.
+func (h *InternalHandler) RevokeCredential(c fiber.Ctx) error {
+	authHeader := c.Get("Authorization")
+
+	if authHeader != h.Env.InternalSecret {
+		return utils.SendError(c, fiber.StatusUnauthorized, "Unauthorized")
+	}
+
+	revoked, err := h.Database.RevokeUploadCredential(c.Params("credentialId"))
+	if err != nil {
+		log.Println(err)
+		return utils.SendError(c, fiber.StatusInternalServerError, "Failed to revoke credential")
+	}
+	if !revoked {
+		return utils.SendError(c, fiber.StatusNotFound, "Credential not found")
+	}
+
+	return c.JSON(fiber.Map{
+		"status": "revoked",
+	})
+}
+
+func credentialJSON(credential *security.UploadCredential) fiber.Map {
+	return fiber.Map{
+		"id":         credential.Id,
+		"userId":     credential.UserId,
+		"name":       credential.Name,
+		"categories": credential.Categories,
+		"groupIds":   credential.GroupIds,
+		"rateLimit":  credential.RateLimit,
+		"createdAt":  credential.CreatedAt.UnixMilli(),
+	}
+}
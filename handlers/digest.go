@@ -0,0 +1,58 @@
+package handlers
+
+import (
+	"cdn_nerimity_go/utils"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"strings"
+
+	"github.com/gofiber/fiber/v3"
+)
+
+// contentDigest is a checksum the client sent along with the body, the body is rejected if it doesn't match.
+type contentDigest struct {
+	Algorithm string // "sha-256" or "md5"
+	Value     []byte
+}
+
+// parseContentDigest reads Repr-Digest (RFC 9530), Digest (RFC 3230) or Content-MD5, in that order.
+// Returns nil when the client didn't send a digest using an algorithm we support.
+func parseContentDigest(c fiber.Ctx, get func(string) string) (*contentDigest, error) {
+	if header := get("Repr-Digest"); header != "" {
+		for _, member := range strings.Split(header, ",") {
+			key, value, _ := strings.Cut(strings.TrimSpace(member), "=")
+			if strings.ToLower(key) != "sha-256" {
+				continue
+			}
+			if len(value) < 2 || value[0] != ':' || value[len(value)-1] != ':' {
+				return nil, utils.SendError(c, fiber.StatusBadRequest, "Invalid Repr-Digest header")
+			}
+			return decodeContentDigest(c, "sha-256", value[1:len(value)-1], sha256.Size)
+		}
+	}
+
+	if header := get("Digest"); header != "" {
+		for _, member := range strings.Split(header, ",") {
+			key, value, _ := strings.Cut(strings.TrimSpace(member), "=")
+			if strings.ToLower(key) != "sha-256" {
+				continue
+			}
+			return decodeContentDigest(c, "sha-256", value, sha256.Size)
+		}
+	}
+
+	if header := get("Content-MD5"); header != "" {
+		return decodeContentDigest(c, "md5", strings.TrimSpace(header), md5.Size)
+	}
+
+	return nil, nil
+}
+
+func decodeContentDigest(c fiber.Ctx, algorithm string, value string, size int) (*contentDigest, error) {
+	decoded, err := base64.StdEncoding.DecodeString(value)
+	if err != nil || len(decoded) != size {
+		return nil, utils.SendError(c, fiber.StatusBadRequest, "Invalid "+algorithm+" digest")
+	}
+	return &contentDigest{Algorithm: algorithm, Value: decoded}, nil
+}
@@ -0,0 +1,73 @@
+package handlers
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"testing"
+)
+
+func TestParseContentDigest(t *testing.T) {
+	body := []byte("hello world")
+	sha := sha256.Sum256(body)
+	md := md5.Sum(body)
+	shaBase64 := base64.StdEncoding.EncodeToString(sha[:])
+	mdBase64 := base64.StdEncoding.EncodeToString(md[:])
+
+	tests := []struct {
+		name      string
+		headers   map[string]string
+		algorithm string
+		value     []byte
+		wantErr   bool
+	}{
+		{name: "none", headers: map[string]string{}},
+		{name: "repr-digest", headers: map[string]string{"Repr-Digest": "sha-256=:" + shaBase64 + ":"}, algorithm: "sha-256", value: sha[:]},
+		{name: "repr-digest with other algorithms", headers: map[string]string{"Repr-Digest": "sha-512=:AAAA:, SHA-256=:" + shaBase64 + ":"}, algorithm: "sha-256", value: sha[:]},
+		{name: "repr-digest without colons", headers: map[string]string{"Repr-Digest": "sha-256=" + shaBase64}, wantErr: true},
+		{name: "repr-digest only unsupported", headers: map[string]string{"Repr-Digest": "sha-512=:AAAA:"}},
+		{name: "digest", headers: map[string]string{"Digest": "SHA-256=" + shaBase64}, algorithm: "sha-256", value: sha[:]},
+		{name: "digest after md5", headers: map[string]string{"Digest": "md5=" + mdBase64 + ", sha-256=" + shaBase64}, algorithm: "sha-256", value: sha[:]},
+		{name: "digest of the wrong size", headers: map[string]string{"Digest": "sha-256=" + mdBase64}, wantErr: true},
+		{name: "digest not base64", headers: map[string]string{"Digest": "sha-256=not base64"}, wantErr: true},
+		{name: "content-md5", headers: map[string]string{"Content-MD5": " " + mdBase64 + " "}, algorithm: "md5", value: md[:]},
+		{name: "content-md5 of the wrong size", headers: map[string]string{"Content-MD5": shaBase64}, wantErr: true},
+		{
+			name:      "repr-digest wins",
+			headers:   map[string]string{"Repr-Digest": "sha-256=:" + shaBase64 + ":", "Digest": "sha-256=invalid", "Content-MD5": mdBase64},
+			algorithm: "sha-256",
+			value:     sha[:],
+		},
+		{
+			name:      "unsupported digest falls through to content-md5",
+			headers:   map[string]string{"Digest": "sha-512=AAAA", "Content-MD5": mdBase64},
+			algorithm: "md5",
+			value:     md[:],
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			digest, err := parseContentDigest(nil, func(key string) string { return test.headers[key] })
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("parseContentDigest = %+v, want an error", digest)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if test.algorithm == "" {
+				if digest != nil {
+					t.Errorf("parseContentDigest = %+v, want nil", digest)
+				}
+				return
+			}
+			if digest == nil || digest.Algorithm != test.algorithm || !bytes.Equal(digest.Value, test.value) {
+				t.Errorf("parseContentDigest = %+v, want %s %x", digest, test.algorithm, test.value)
+			}
+		})
+	}
+}
@@ -0,0 +1,93 @@
+package handlers
+
+import (
+	"cdn_nerimity_go/security"
+	"cdn_nerimity_go/utils"
+	"strings"
+
+	"github.com/gofiber/fiber/v3"
+	"github.com/valyala/fasthttp"
+)
+
+// HeaderReceived is used as the fasthttp HeaderReceived hook.
+// Uploads sent with "Expect: 100-continue" are checked from their headers before the body is asked for,
+// a rejected upload never gets its 100 Continue and UploadFile answers with the error instead.
+func (h *UploadHandler) HeaderReceived(header *fasthttp.RequestHeader) fasthttp.RequestConfig {
+	// Request contexts are pooled, drop whatever a previous request on this header left behind
+	// when it never reached UploadFile to take it.
+	h.earlyRejections.Delete(header)
+
+	if !header.IsPost() || !strings.EqualFold(string(header.Peek(fiber.HeaderExpect)), "100-continue") {
+		return fasthttp.RequestConfig{}
+	}
+
+	category, groupId, ok := parseUploadPath(string(header.RequestURI()))
+	if !ok {
+		return fasthttp.RequestConfig{}
+	}
+
+	err := checkUploadHeaders(h, header, category, groupId)
+	if err == nil {
+		return fasthttp.RequestConfig{}
+	}
+
+	// Without the Expect header and a body fasthttp goes straight to the handler,
+	// the connection is closed afterwards in case the client sends the body anyway.
+	header.Del(fiber.HeaderExpect)
+	header.SetContentLength(0)
+	header.SetConnectionClose()
+	h.earlyRejections.Store(header, err)
+	return fasthttp.RequestConfig{}
+}
+
+// takeEarlyRejection returns the error HeaderReceived found for this request, if any.
+func takeEarlyRejection(c fiber.Ctx, h *UploadHandler) error {
+	err, ok := h.earlyRejections.LoadAndDelete(&c.Request().Header)
+	if !ok {
+		return nil
+	}
+	return err.(error)
+}
+
+// parseUploadPath matches the UploadFile routes: /emojis and /<category>/:groupId.
+func parseUploadPath(uri string) (utils.FileCategory, string, bool) {
+	path, _, _ := strings.Cut(uri, "?")
+	segments := strings.Split(strings.TrimSuffix(path, "/"), "/")
+	if len(segments) < 2 {
+		return "", "", false
+	}
+
+	category := utils.FileCategory(strings.ToLower(segments[1]))
+	switch category {
+	case utils.EmojisCategory:
+		return category, "", len(segments) == 2
+	case utils.AttachmentsCategory, utils.AvatarsCategory, utils.ProfileBannersCategory:
+		if len(segments) != 3 {
+			return "", "", false
+		}
+		return category, segments[2], true
+	}
+	return "", "", false
+}
+
+// checkUploadHeaders runs the auth and validate checks of UploadFile on the headers alone.
+// There is no fiber.Ctx before the body is read, auth and validateDeclared only use it to build the error.
+// HeaderReceived runs on the connection's goroutine before the request is routed, so nothing here may
+// block on the database: upload credentials are only looked up and scope checked by UploadFile.
+func checkUploadHeaders(h *UploadHandler, header *fasthttp.RequestHeader, category utils.FileCategory, groupId string) error {
+	token := string(header.Peek(fiber.HeaderAuthorization))
+	if !security.IsCredentialToken(token) {
+		if _, err := verifyAuthorization(nil, h, token); err != nil {
+			return err
+		}
+	}
+
+	filename, err := utils.DecodeURIComponent(string(header.Peek("File-Name")))
+	if err != nil {
+		return utils.SendError(nil, fiber.StatusBadRequest, "Invalid file name")
+	}
+	fileContentType := string(header.ContentType())
+	isMultipart := strings.HasPrefix(fileContentType, fiber.MIMEMultipartForm)
+
+	return validateDeclared(nil, h, category, groupId, filename, fileContentType, int64(header.ContentLength()), isMultipart)
+}
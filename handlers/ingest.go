@@ -0,0 +1,111 @@
+package handlers
+
+import (
+	"cdn_nerimity_go/utils"
+	"mime"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/gofiber/fiber/v3"
+)
+
+type IngestRequest struct {
+	Url      string `json:"url"`
+	Category string `json:"category"`
+	UserId   string `json:"userId"`
+	GroupId  string `json:"groupId"`
+	// Filename defaults to the last segment of the URL.
+	Filename string `json:"filename"`
+}
+
+// Ingest downloads a remote file on behalf of a user and stores it like an upload followed by VerifyFile.
+// The URL goes through the same checks as the image proxy.
+func (h *InternalHandler) Ingest(c fiber.Ctx) error {
+	authHeader := c.Get("Authorization")
+
+	if authHeader != h.Env.InternalSecret {
+		return utils.SendError(c, fiber.StatusUnauthorized, "Unauthorized")
+	}
+	body := new(IngestRequest)
+
+	if err := c.Bind().Body(body); err != nil {
+		return err
+	}
+
+	userId, err := strconv.ParseInt(body.UserId, 10, 64)
+	if err != nil {
+		return utils.SendError(c, fiber.StatusBadRequest, "Invalid user Id")
+	}
+
+	groupId := int64(0)
+	if body.GroupId != "" {
+		groupId, err = strconv.ParseInt(body.GroupId, 10, 64)
+		if err != nil {
+			return utils.SendError(c, fiber.StatusBadRequest, "Invalid group Id")
+		}
+	}
+
+	category := utils.FileCategory(strings.ToLower(body.Category))
+	policy := h.Env.UploadPolicy(string(category))
+	if policy == nil {
+		return utils.SendError(c, fiber.StatusBadRequest, "Invalid category")
+	}
+
+	resp, fetchErr := fetchRemote(body.Url)
+	if fetchErr != nil {
+		return fetchErr
+	}
+	defer resp.Body.Close()
+
+	if resp.ContentLength > policy.MaxBytes {
+		return utils.SendError(c, fiber.StatusRequestEntityTooLarge, "File too large")
+	}
+
+	mimeType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	filename := ingestFilename(body, mimeType)
+
+	pendingFile, err := writeTempFile(c, h.UploadHandler, resp.Body, filename, mimeType, category, policy.MaxBytes, nil)
+	if err != nil {
+		return err
+	}
+	pendingFile.UserId = userId
+	pendingFile.GroupId = groupId
+
+	err = processTempFile(c, h.UploadHandler, pendingFile)
+	if err != nil {
+		os.Remove(pendingFile.Path)
+		return err
+	}
+
+	json, err := verifyPendingFile(c, h, userId, pendingFile.FileId, groupId)
+	if err != nil {
+		// Nobody else knows about the file, so it won't be verified later either.
+		h.PendingStore.Remove(pendingFile.FileId)
+		os.Remove(pendingFile.Path)
+		return err
+	}
+	return c.JSON(json)
+}
+
+// ingestFilename picks the name of an ingested file, adding an extension from the
+// Content-Type when the URL has none so images are still recognised as images.
+func ingestFilename(body *IngestRequest, mimeType string) string {
+	filename := body.Filename
+	if filename == "" {
+		if parsed, err := url.Parse(body.Url); err == nil {
+			filename = path.Base(parsed.Path)
+		}
+	}
+	if filename == "" || filename == "/" || filename == "." {
+		filename = "file"
+	}
+
+	if filepath.Ext(filename) == "" {
+		filename += utils.ExtensionForMimeType(mimeType)
+	}
+	return filename
+}
@@ -5,6 +5,7 @@ import (
 	"cdn_nerimity_go/database"
 	"cdn_nerimity_go/security"
 	"cdn_nerimity_go/utils"
+	"errors"
 	"log"
 	"os"
 	"path/filepath"
@@ -16,10 +17,13 @@ import (
 )
 
 type InternalHandler struct {
-	Env                *config.Config
-	Jwt                *security.JWTService
-	PendingFileManager *utils.PendingFilesManager
-	Database           *database.DatabaseService
+	Env          *config.Config
+	Jwt          *security.JWTService
+	Flake        *utils.Flake
+	PendingStore utils.PendingStore
+	Database     *database.DatabaseService
+	// UploadHandler runs ingested files through the same pipeline as uploads.
+	UploadHandler *UploadHandler
 }
 
 func NewInternalHandler(context *InternalHandler) *InternalHandler {
@@ -93,16 +97,45 @@ func (h *InternalHandler) VerifyFile(c fiber.Ctx) error {
 		}
 	}
 
-	pendingFile, err := h.PendingFileManager.Verify(fileId)
-	if pendingFile == nil {
-		return utils.SendError(c, fiber.StatusBadRequest, err.Error())
+	json, err := verifyPendingFile(c, h, userId, fileId, groupId)
+	if err != nil {
+		return err
+	}
+	return c.JSON(json)
+}
+
+// verifyPendingFile moves a pending file to public/ and returns the payload describing it.
+func verifyPendingFile(c fiber.Ctx, h *InternalHandler, userId int64, fileId int64, groupId int64) (fiber.Map, error) {
+	_, json, err := placePendingFile(c, h, userId, fileId, groupId)
+	return json, err
+}
+
+// placedFile is what unplacePendingFile needs to undo placePendingFile.
+type placedFile struct {
+	PendingFile *utils.PendingFile
+	SrcPath     string
+	DstPath     string
+	ExpireAdded bool
+}
+
+// placePendingFile does the work of verifyPendingFile.
+func placePendingFile(c fiber.Ctx, h *InternalHandler, userId int64, fileId int64, groupId int64) (*placedFile, fiber.Map, error) {
+	// Everything that can reject the file is checked before Verify takes it out of the store,
+	// so a rejected file stays pending for a request that is allowed to verify it.
+	pendingFile, err := h.PendingStore.Get(fileId)
+	if errors.Is(err, utils.ErrPendingFileNotFound) || errors.Is(err, utils.ErrPendingFileExpired) {
+		return nil, nil, utils.SendError(c, fiber.StatusBadRequest, err.Error())
+	}
+	if err != nil {
+		log.Printf("Failed to get pending file %d: %v", fileId, err)
+		return nil, nil, utils.SendError(c, fiber.StatusInternalServerError, "Failed to get pending file")
 	}
 
 	if pendingFile.UserId != userId {
-		return utils.SendError(c, fiber.StatusUnauthorized, "Invalid UserId")
+		return nil, nil, utils.SendError(c, fiber.StatusUnauthorized, "Invalid UserId")
 	}
 	if pendingFile.GroupId != 0 && pendingFile.GroupId != groupId {
-		return utils.SendError(c, fiber.StatusUnauthorized, "Invalid GroupId")
+		return nil, nil, utils.SendError(c, fiber.StatusUnauthorized, "Invalid GroupId")
 	}
 
 	var newPath = ""
@@ -127,7 +160,28 @@ func (h *InternalHandler) VerifyFile(c fiber.Ctx) error {
 	}
 
 	if newPath == "" {
-		return utils.SendError(c, fiber.StatusUnauthorized, "Invalid Category type")
+		return nil, nil, utils.SendError(c, fiber.StatusUnauthorized, "Invalid Category type")
+	}
+
+	pendingFile, err = h.PendingStore.Verify(fileId)
+	if errors.Is(err, utils.ErrPendingFileNotFound) || errors.Is(err, utils.ErrPendingFileExpired) {
+		return nil, nil, utils.SendError(c, fiber.StatusBadRequest, err.Error())
+	}
+	if err != nil {
+		log.Printf("Failed to get pending file %d: %v", fileId, err)
+		return nil, nil, utils.SendError(c, fiber.StatusInternalServerError, "Failed to get pending file")
+	}
+	// The file is still in temp/ until it is placed, so a failure before that makes it pending again.
+	expireAdded := false
+	restorePending := func() {
+		if expireAdded {
+			if err := h.Database.DeleteByFileIds([]int64{fileId}); err != nil {
+				log.Printf("Failed to remove the expire record of file %d: %v", fileId, err)
+			}
+		}
+		if err := h.PendingStore.Add(pendingFile); err != nil {
+			log.Printf("Failed to restore pending file %d: %v", fileId, err)
+		}
 	}
 
 	var expireAt int64
@@ -135,9 +189,12 @@ func (h *InternalHandler) VerifyFile(c fiber.Ctx) error {
 		createdAt, err := h.Database.AddExpire(fileId, groupId)
 		if err != nil {
 			log.Println(err)
-			return utils.SendError(c, fiber.StatusInternalServerError, "Failed to add expire.")
+			restorePending()
+			return nil, nil, utils.SendError(c, fiber.StatusInternalServerError, "Failed to add expire.")
 		}
 
+		expireAdded = true
+
 		futureTime := createdAt.Add(24 * time.Hour)
 		expireAt = futureTime.UnixMilli()
 
@@ -145,12 +202,20 @@ func (h *InternalHandler) VerifyFile(c fiber.Ctx) error {
 
 	err = os.MkdirAll(filepath.Dir(h.Env.ProjectRoot+"/public/"+newPath), 0755)
 	if err != nil {
-		return utils.SendError(c, fiber.StatusInternalServerError, "Failed to create directory.")
+		restorePending()
+		return nil, nil, utils.SendError(c, fiber.StatusInternalServerError, "Failed to create directory.")
 	}
 
-	err = os.Rename(h.Env.ProjectRoot+"/"+pendingFile.Path, h.Env.ProjectRoot+"/public/"+newPath)
+	srcPath := h.Env.ProjectRoot + "/" + pendingFile.Path
+	dstPath := h.Env.ProjectRoot + "/public/" + newPath
+	if pendingFile.Sha256 != "" {
+		err = utils.PlaceFile(h.Env.ProjectRoot, pendingFile.Sha256, srcPath, dstPath)
+	} else {
+		err = utils.MoveFile(srcPath, dstPath, h.Env.ProjectRoot+"/public")
+	}
 	if err != nil {
-		return utils.SendError(c, fiber.StatusInternalServerError, "Failed to rename file.")
+		restorePending()
+		return nil, nil, utils.SendError(c, fiber.StatusInternalServerError, "Failed to rename file.")
 	}
 
 	name := filepath.Base(newPath)
@@ -171,6 +236,18 @@ func (h *InternalHandler) VerifyFile(c fiber.Ctx) error {
 		"mimetype":   pendingFile.MimeType,
 		"compressed": pendingFile.ImageCompressed,
 	}
+	if pendingFile.Digest != "" {
+		json["digest"] = fiber.Map{
+			"algorithm": pendingFile.DigestAlgorithm,
+			"value":     pendingFile.Digest,
+		}
+	}
+	if pendingFile.ScanStatus != "" {
+		json["scanStatus"] = pendingFile.ScanStatus
+	}
+	if pendingFile.DetectedMimeType != "" {
+		json["detectedMimetype"] = pendingFile.DetectedMimeType
+	}
 	if expireAt > 0 {
 		json["expireAt"] = expireAt
 	}
@@ -183,8 +260,46 @@ func (h *InternalHandler) VerifyFile(c fiber.Ctx) error {
 	if pendingFile.Width > 0 {
 		json["width"] = pendingFile.Width
 	}
+	if pendingFile.OriginalWidth > 0 && pendingFile.OriginalHeight > 0 {
+		json["originalWidth"] = pendingFile.OriginalWidth
+		json["originalHeight"] = pendingFile.OriginalHeight
+	}
 
-	return c.JSON(json)
+	placed := &placedFile{
+		PendingFile: pendingFile,
+		SrcPath:     srcPath,
+		DstPath:     dstPath,
+		ExpireAdded: expireAdded,
+	}
+	return placed, json, nil
+}
+
+// unplacePendingFile moves a placed file back to temp/ and makes it pending again.
+// An error means the file could not be moved and is still published. Once it is moved back,
+// failing to clean up its expire record or to make it pending again is only logged.
+func unplacePendingFile(h *InternalHandler, placed *placedFile) error {
+	fileId := placed.PendingFile.FileId
+	err := utils.UnplaceFile(h.Env.ProjectRoot, placed.DstPath, placed.SrcPath)
+	if err != nil {
+		return err
+	}
+	// Attachments get a directory of their own.
+	if placed.PendingFile.Type == utils.AttachmentsCategory {
+		os.Remove(filepath.Dir(placed.DstPath))
+	}
+
+	if placed.ExpireAdded {
+		err = h.Database.DeleteByFileIds([]int64{fileId})
+		if err != nil {
+			log.Printf("Failed to remove the expire record of rolled back file %d: %v", fileId, err)
+		}
+	}
+
+	err = h.PendingStore.Add(placed.PendingFile)
+	if err != nil {
+		log.Printf("Failed to make rolled back file %d pending again: %v", fileId, err)
+	}
+	return nil
 }
 
 func (h *InternalHandler) DeleteByFileIds(c fiber.Ctx) error {
@@ -214,7 +329,7 @@ func (h *InternalHandler) DeleteByFileIds(c fiber.Ctx) error {
 		if strings.HasSuffix(path, "#a") {
 			path = strings.TrimSuffix(path, "#a")
 		}
-		utils.DeleteRecursiveEmpty(h.Env.ProjectRoot + "/public/" + path)
+		utils.DeleteRecursiveEmpty(h.Env.ProjectRoot, h.Env.ProjectRoot+"/public/"+path)
 	}
 
 	return c.JSON(fiber.Map{
@@ -248,7 +363,7 @@ func (h *InternalHandler) DeleteAttachmentsByGroupId(c fiber.Ctx) error {
 
 	for _, entry := range entries {
 		fullPath := filepath.Join(groupPath, entry.Name())
-		os.RemoveAll(fullPath)
+		utils.RemoveAllWithBlobs(h.Env.ProjectRoot, fullPath)
 	}
 
 	os.Remove(groupPath)
@@ -288,7 +403,7 @@ func (h *InternalHandler) DeleteFile(c fiber.Ctx) error {
 	}
 	fullPath := h.Env.ProjectRoot + "/public/" + decodedPath
 
-	err = utils.DeleteRecursiveEmpty(fullPath)
+	err = utils.DeleteRecursiveEmpty(h.Env.ProjectRoot, fullPath)
 
 	if err != nil {
 		return c.Status(400).JSON(fiber.Map{"error": "Failed to delete file"})
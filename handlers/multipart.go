@@ -0,0 +1,128 @@
+package handlers
+
+import (
+	"cdn_nerimity_go/security"
+	"cdn_nerimity_go/utils"
+	"errors"
+	"io"
+	"mime"
+	"mime/multipart"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/gofiber/fiber/v3"
+)
+
+// handleMultipartUpload accepts a multipart/form-data body with one or more files.
+// Every file part gets its own fileId; the size limit of the category applies to all parts together.
+func handleMultipartUpload(c fiber.Ctx, h *UploadHandler, claims *security.Claims) error {
+	_, params, err := mime.ParseMediaType(string(c.Request().Header.ContentType()))
+	if err != nil || params["boundary"] == "" {
+		return utils.SendError(c, fiber.StatusBadRequest, "Invalid multipart boundary")
+	}
+
+	attachmentCategory := utils.FileCategory(strings.ToLower(strings.Split(c.Path(), "/")[1]))
+	policy := h.Env.UploadPolicy(string(attachmentCategory))
+	if policy == nil {
+		return utils.SendError(c, fiber.StatusBadRequest, "Invalid category")
+	}
+
+	var groupId, userId int64
+	if c.Params("groupId") != "" {
+		groupId, _ = strconv.ParseInt(c.Params("groupId"), 10, 64)
+	}
+	if claims.UserId != "" {
+		userId, _ = strconv.ParseInt(claims.UserId, 10, 64)
+	}
+
+	var pendingFiles []*utils.PendingFile
+	success := false
+	defer func() {
+		if !success {
+			for _, pendingFile := range pendingFiles {
+				os.Remove(pendingFile.Path)
+			}
+		}
+	}()
+
+	remaining := policy.MaxBytes
+	body := uploadBody(c, h)
+	reader := multipart.NewReader(body, params["boundary"])
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if errors.Is(err, utils.ErrUploadStalled) {
+			return abortStalledUpload(c, body.Total)
+		}
+		if err != nil {
+			return utils.SendError(c, fiber.StatusBadRequest, "Invalid multipart body")
+		}
+
+		if part.FileName() == "" {
+			part.Close()
+			continue
+		}
+
+		digest, err := parseContentDigest(c, part.Header.Get)
+		if err != nil {
+			part.Close()
+			return err
+		}
+
+		pendingFile, err := writeTempFile(c, h, part, part.FileName(), part.Header.Get("Content-Type"), attachmentCategory, remaining, digest)
+		part.Close()
+		if err != nil {
+			return err
+		}
+		pendingFiles = append(pendingFiles, pendingFile)
+		remaining -= int64(pendingFile.FileSize)
+	}
+
+	if len(pendingFiles) == 0 {
+		return utils.SendError(c, fiber.StatusBadRequest, "No files were sent")
+	}
+	success = true
+
+	results := make([]fiber.Map, 0, len(pendingFiles))
+	for _, pendingFile := range pendingFiles {
+		pendingFile.GroupId = groupId
+		pendingFile.UserId = userId
+
+		err := processTempFile(c, h, pendingFile)
+		if err != nil {
+			os.Remove(pendingFile.Path)
+
+			results = append(results, fiber.Map{
+				"filename": pendingFile.OriginalFilename,
+				"error":    errorMessage(err),
+			})
+			continue
+		}
+
+		results = append(results, fiber.Map{
+			"filename": pendingFile.OriginalFilename,
+			"fileId":   strconv.FormatInt(pendingFile.FileId, 10),
+		})
+	}
+
+	return c.JSON(results)
+}
+
+// processTempFile checks a file written by writeTempFile against its category and processes it.
+// Used when the type and size could not be validated before the body was read.
+func processTempFile(c fiber.Ctx, h *UploadHandler, pendingFile *utils.PendingFile) error {
+	isImage, isAudioOrVideo, err := handleSniff(c, h, pendingFile, pendingFile.MimeType)
+	if err != nil {
+		return err
+	}
+
+	policy := h.Env.UploadPolicy(string(pendingFile.Type))
+	if pendingFile.Type != utils.AttachmentsCategory && int64(pendingFile.FileSize) > policy.CompressMaxBytes {
+		return utils.SendError(c, fiber.StatusBadRequest, "Image exceeds size limit")
+	}
+
+	return processPendingFile(c, h, pendingFile, isImage, isAudioOrVideo)
+}
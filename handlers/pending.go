@@ -0,0 +1,235 @@
+package handlers
+
+import (
+	"cdn_nerimity_go/config"
+	"cdn_nerimity_go/utils"
+	"errors"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v3"
+)
+
+// ExtendUpload lets the uploader keep a pending file alive while it is still being used, e.g. a message
+// with an attachment is still being written.
+func (h *UploadHandler) ExtendUpload(c fiber.Ctx) error {
+	claims, err := auth(c, h)
+	if err != nil {
+		return err
+	}
+
+	userId, err := strconv.ParseInt(claims.UserId, 10, 64)
+	if err != nil {
+		return utils.SendError(c, fiber.StatusUnauthorized, "Invalid token")
+	}
+	fileId, err := strconv.ParseInt(c.Params("fileId"), 10, 64)
+	if err != nil {
+		return utils.SendError(c, fiber.StatusBadRequest, "Invalid file Id")
+	}
+
+	json, err := extendPendingFile(c, h.Env, h.PendingStore, userId, fileId)
+	if err != nil {
+		return err
+	}
+	return c.JSON(json)
+}
+
+// CancelUpload removes a pending file of the caller right away, e.g. an attachment that was taken out of the composer.
+func (h *UploadHandler) CancelUpload(c fiber.Ctx) error {
+	claims, err := auth(c, h)
+	if err != nil {
+		return err
+	}
+
+	userId, err := strconv.ParseInt(claims.UserId, 10, 64)
+	if err != nil {
+		return utils.SendError(c, fiber.StatusUnauthorized, "Invalid token")
+	}
+	fileId, err := strconv.ParseInt(c.Params("fileId"), 10, 64)
+	if err != nil {
+		return utils.SendError(c, fiber.StatusBadRequest, "Invalid file Id")
+	}
+
+	pendingFile, err := h.PendingStore.Get(fileId)
+	if err != nil {
+		return pendingStoreError(c, fileId, err)
+	}
+	if pendingFile.UserId != userId {
+		return utils.SendError(c, fiber.StatusForbidden, "File belongs to another user")
+	}
+
+	// The file may have been verified since Get, then it is no longer ours to remove.
+	pendingFile, err = h.PendingStore.Remove(fileId)
+	if err != nil {
+		return pendingStoreError(c, fileId, err)
+	}
+	os.Remove(pendingFile.Path)
+
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+type ExtendFileRequest struct {
+	UserId string `json:"userId"`
+	FileId string `json:"fileId"`
+}
+
+// ExtendFile is ExtendUpload for the backend.
+func (h *InternalHandler) ExtendFile(c fiber.Ctx) error {
+	authHeader := c.Get("Authorization")
+
+	if authHeader != h.Env.InternalSecret {
+		return utils.SendError(c, fiber.StatusUnauthorized, "Unauthorized")
+	}
+	body := new(ExtendFileRequest)
+
+	if err := c.Bind().Body(body); err != nil {
+		return err
+	}
+
+	userId, err := strconv.ParseInt(body.UserId, 10, 64)
+	if err != nil {
+		return utils.SendError(c, fiber.StatusBadRequest, "Invalid user Id")
+	}
+	fileId, err := strconv.ParseInt(body.FileId, 10, 64)
+	if err != nil {
+		return utils.SendError(c, fiber.StatusBadRequest, "Invalid file Id")
+	}
+
+	json, err := extendPendingFile(c, h.Env, h.PendingStore, userId, fileId)
+	if err != nil {
+		return err
+	}
+	return c.JSON(json)
+}
+
+// extendPendingFile moves the expiry of a pending file one TTL of its category ahead,
+// but never past the maximum lifetime counted from the upload.
+func extendPendingFile(c fiber.Ctx, env *config.Config, store utils.PendingStore, userId int64, fileId int64) (fiber.Map, error) {
+	pendingFile, err := store.Get(fileId)
+	if err != nil {
+		return nil, pendingStoreError(c, fileId, err)
+	}
+	if pendingFile.UserId != userId {
+		return nil, utils.SendError(c, fiber.StatusForbidden, "File belongs to another user")
+	}
+
+	policy := env.UploadPolicy(string(pendingFile.Type))
+	expiresAt := time.Now().Add(policy.PendingTTL())
+	if maxExpiresAt := pendingFile.CreatedAt.Add(policy.PendingMaxLifetime()); expiresAt.After(maxExpiresAt) {
+		expiresAt = maxExpiresAt
+	}
+
+	if expiresAt.After(pendingFile.ExpiresAt) {
+		err = store.Extend(fileId, expiresAt)
+		if err != nil {
+			return nil, pendingStoreError(c, fileId, err)
+		}
+		pendingFile.ExpiresAt = expiresAt
+	}
+
+	return fiber.Map{
+		"fileId":    strconv.FormatInt(fileId, 10),
+		"expiresAt": pendingFile.ExpiresAt.UnixMilli(),
+	}, nil
+}
+
+// pendingStoreError answers 404 for files that are gone and hides store failures behind a 500.
+func pendingStoreError(c fiber.Ctx, fileId int64, err error) error {
+	if errors.Is(err, utils.ErrPendingFileNotFound) || errors.Is(err, utils.ErrPendingFileExpired) {
+		return utils.SendError(c, fiber.StatusNotFound, err.Error())
+	}
+	log.Printf("Failed to get pending file %d: %v", fileId, err)
+	return utils.SendError(c, fiber.StatusInternalServerError, "Failed to get pending file")
+}
+
+const (
+	defaultPendingFilesLimit = 100
+	maxPendingFilesLimit     = 1000
+)
+
+// ListPendingFiles shows the uploads waiting to be verified and how much of temp/ they use.
+// Filtered by the userId, groupId and category query parameters, limit caps the listed files but not the totals.
+func (h *InternalHandler) ListPendingFiles(c fiber.Ctx) error {
+	authHeader := c.Get("Authorization")
+
+	if authHeader != h.Env.InternalSecret {
+		return utils.SendError(c, fiber.StatusUnauthorized, "Unauthorized")
+	}
+
+	filter := utils.PendingFilter{
+		Category: utils.FileCategory(strings.ToLower(c.Query("category"))),
+		Limit:    defaultPendingFilesLimit,
+	}
+
+	var err error
+	if userId := c.Query("userId"); userId != "" {
+		filter.UserId, err = strconv.ParseInt(userId, 10, 64)
+		if err != nil {
+			return utils.SendError(c, fiber.StatusBadRequest, "Invalid user Id")
+		}
+	}
+	if groupId := c.Query("groupId"); groupId != "" {
+		filter.GroupId, err = strconv.ParseInt(groupId, 10, 64)
+		if err != nil {
+			return utils.SendError(c, fiber.StatusBadRequest, "Invalid group Id")
+		}
+	}
+	if filter.Category != "" && h.Env.UploadPolicy(string(filter.Category)) == nil {
+		return utils.SendError(c, fiber.StatusBadRequest, "Invalid category")
+	}
+	if limit := c.Query("limit"); limit != "" {
+		filter.Limit, err = strconv.Atoi(limit)
+		if err != nil || filter.Limit <= 0 {
+			return utils.SendError(c, fiber.StatusBadRequest, "Invalid limit")
+		}
+		filter.Limit = min(filter.Limit, maxPendingFilesLimit)
+	}
+
+	files, totals, err := h.PendingStore.List(filter)
+	if err != nil {
+		log.Printf("Failed to list pending files: %v", err)
+		return utils.SendError(c, fiber.StatusInternalServerError, "Failed to list pending files")
+	}
+
+	json := make([]fiber.Map, 0, len(files))
+	for _, file := range files {
+		json = append(json, pendingFileJSON(file))
+	}
+	return c.JSON(fiber.Map{
+		"files":  json,
+		"totals": totals,
+	})
+}
+
+func pendingFileJSON(file *utils.PendingFile) fiber.Map {
+	json := fiber.Map{
+		"fileId":    strconv.FormatInt(file.FileId, 10),
+		"userId":    strconv.FormatInt(file.UserId, 10),
+		"groupId":   strconv.FormatInt(file.GroupId, 10),
+		"category":  file.Type,
+		"filename":  file.OriginalFilename,
+		"filesize":  file.FileSize,
+		"mimetype":  file.MimeType,
+		"animated":  file.Animated,
+		"createdAt": file.CreatedAt.UnixMilli(),
+		"expiresAt": file.ExpiresAt.UnixMilli(),
+	}
+	if file.ScanStatus != "" {
+		json["scanStatus"] = file.ScanStatus
+	}
+	if file.Duration > 0 {
+		json["duration"] = file.Duration
+	}
+	if file.Width > 0 && file.Height > 0 {
+		json["width"] = file.Width
+		json["height"] = file.Height
+	}
+	if file.OriginalWidth > 0 && file.OriginalHeight > 0 {
+		json["originalWidth"] = file.OriginalWidth
+		json["originalHeight"] = file.OriginalHeight
+	}
+	return json
+}
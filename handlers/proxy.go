@@ -14,7 +14,6 @@ import (
 	"strconv"
 	"time"
 
-	"github.com/cshum/vipsgen/vips"
 	"github.com/gofiber/fiber/v3"
 	"github.com/gofiber/fiber/v3/middleware/proxy"
 )
@@ -38,41 +37,12 @@ func (h *ProxyHandler) GetImageDimensions(c fiber.Ctx) error {
 		return c.Status(fiber.StatusBadRequest).SendString("Missing url parameter")
 	}
 
-	parsed, err := url.Parse(rawURL)
-	if err != nil || !isValidScheme(parsed.Scheme) {
-		return c.Status(fiber.StatusBadRequest).SendString("Invalid URL")
-	}
-	if err := validateHost(parsed.Hostname()); err != nil {
-		return c.Status(fiber.StatusBadRequest).SendString("Blocked host")
-	}
-
-	client := &http.Client{
-		Timeout: requestTimeout,
-		CheckRedirect: func(req *http.Request, via []*http.Request) error {
-			if len(via) >= 3 {
-				return errors.New("too many redirects")
-			}
-			return validateHost(req.URL.Hostname())
-		},
-	}
-
-	req, err := http.NewRequestWithContext(context.Background(), http.MethodGet, rawURL, nil)
-	req.Header.Set("User-Agent", "Mozilla/5.0 (compatible; Nerimity/1.0)")
-
-	if err != nil {
-		return c.Status(fiber.StatusBadRequest).SendString("Request creation failed")
-	}
-	resp, err := client.Do(req)
-
-	if err != nil {
-		return c.Status(fiber.StatusBadGateway).SendString("Fetch failed")
+	resp, fetchErr := fetchRemote(rawURL)
+	if fetchErr != nil {
+		return c.Status(fetchErr.Code).SendString(fetchErr.Message)
 	}
 	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		return c.Status(fiber.StatusBadGateway).SendString("Remote server error")
-	}
-
 	if resp.ContentLength > maxImageSize {
 		return c.Status(fiber.StatusRequestEntityTooLarge).SendString("Image too large")
 	}
@@ -92,18 +62,22 @@ func (h *ProxyHandler) GetImageDimensions(c fiber.Ctx) error {
 		return c.Status(fiber.StatusRequestEntityTooLarge).SendString("Image too large")
 	}
 
-	img, err := vips.NewImageFromFile(tmpFile.Name(), nil)
+	header, err := utils.ProbeImage(tmpFile.Name())
 
 	if err != nil {
 		log.Printf("Vips error: %v", err)
 		return c.Status(fiber.StatusUnsupportedMediaType).SendString("Invalid image")
 	}
-	defer img.Close()
+
+	limits := utils.ImageLimits{MaxPixels: h.Env.ProxyMaxPixels, MaxFrames: h.Env.ProxyMaxFrames}
+	if err := limits.Check(header); err != nil {
+		return c.Status(fiber.StatusUnprocessableEntity).SendString(err.Error())
+	}
 
 	return c.JSON(fiber.Map{
-		"width":    img.Width(),
-		"height":   img.Height(),
-		"animated": img.Pages() > 1,
+		"width":    header.Width,
+		"height":   header.Height,
+		"animated": header.Frames > 1,
 	})
 }
 
@@ -126,6 +100,45 @@ func (h *ProxyHandler) GetProxy(c fiber.Ctx) error {
 
 }
 
+// fetchRemote requests a public http(s) URL. The host and the host of every redirect
+// must not resolve to a private address.
+func fetchRemote(rawURL string) (*http.Response, *fiber.Error) {
+	parsed, err := url.Parse(rawURL)
+	if err != nil || !isValidScheme(parsed.Scheme) {
+		return nil, fiber.NewError(fiber.StatusBadRequest, "Invalid URL")
+	}
+	if err := validateHost(parsed.Hostname()); err != nil {
+		return nil, fiber.NewError(fiber.StatusBadRequest, "Blocked host")
+	}
+
+	client := &http.Client{
+		Timeout: requestTimeout,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= 3 {
+				return errors.New("too many redirects")
+			}
+			return validateHost(req.URL.Hostname())
+		},
+	}
+
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodGet, rawURL, nil)
+	if err != nil {
+		return nil, fiber.NewError(fiber.StatusBadRequest, "Request creation failed")
+	}
+	req.Header.Set("User-Agent", "Mozilla/5.0 (compatible; Nerimity/1.0)")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fiber.NewError(fiber.StatusBadGateway, "Fetch failed")
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fiber.NewError(fiber.StatusBadGateway, "Remote server error")
+	}
+	return resp, nil
+}
+
 func isValidScheme(scheme string) bool {
 	return scheme == "http" || scheme == "https"
 }
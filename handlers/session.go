@@ -0,0 +1,123 @@
+package handlers
+
+import (
+	"cdn_nerimity_go/security"
+	"cdn_nerimity_go/utils"
+	"encoding/hex"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v3"
+)
+
+type InitUploadRequest struct {
+	Category string `json:"category"`
+	GroupId  string `json:"groupId"`
+	Filename string `json:"filename"`
+	Size     int64  `json:"size"`
+	MimeType string `json:"mimeType"`
+	Sha256   string `json:"sha256"`
+}
+
+// InitUpload lets a client check an upload against the category policy and its quota before sending it.
+// The returned uploadId is sent back in the Upload-Id header of the upload request.
+func (h *UploadHandler) InitUpload(c fiber.Ctx) error {
+	claims, err := auth(c, h)
+	if err != nil {
+		return err
+	}
+
+	body := new(InitUploadRequest)
+	if err := c.Bind().Body(body); err != nil {
+		return err
+	}
+
+	category := utils.FileCategory(strings.ToLower(body.Category))
+	err = validateDeclared(c, h, category, body.GroupId, body.Filename, body.MimeType, body.Size, false)
+	if err != nil {
+		return err
+	}
+	err = checkCredentialScope(c, claims, category, body.GroupId)
+	if err != nil {
+		return err
+	}
+
+	sha256 := strings.ToLower(body.Sha256)
+	if sha256 != "" {
+		decoded, err := hex.DecodeString(sha256)
+		if err != nil || len(decoded) != 32 {
+			return utils.SendError(c, fiber.StatusBadRequest, "Invalid sha256")
+		}
+	}
+
+	keys, limit := rateLimitFor(c, h, category, claims)
+	if retryAfter, ok := h.RateLimiter.Check(keys, limit, 1, body.Size); !ok {
+		return sendRateLimited(c, retryAfter)
+	}
+
+	session := utils.UploadSession{
+		UploadId:  h.Flake.Generate(),
+		UserId:    claims.UserId,
+		Category:  category,
+		GroupId:   body.GroupId,
+		Filename:  body.Filename,
+		Size:      body.Size,
+		MimeType:  body.MimeType,
+		Sha256:    sha256,
+		ExpiresAt: time.Now().Add(utils.UploadSessionExpiry),
+	}
+	h.UploadSessions.Add(&session)
+
+	return c.JSON(fiber.Map{
+		"uploadId":  strconv.FormatInt(session.UploadId, 10),
+		"expiresAt": session.ExpiresAt.UnixMilli(),
+	})
+}
+
+// takeUploadSession returns the session named by the Upload-Id header, or nil when there is none.
+// The request must match what was declared when the session was created.
+func takeUploadSession(c fiber.Ctx, h *UploadHandler, claims *security.Claims, category utils.FileCategory) (*utils.UploadSession, error) {
+	rawUploadId := c.Get("Upload-Id")
+	if rawUploadId == "" {
+		return nil, nil
+	}
+
+	uploadId, err := strconv.ParseInt(rawUploadId, 10, 64)
+	if err != nil {
+		return nil, utils.SendError(c, fiber.StatusBadRequest, "Invalid upload id")
+	}
+
+	session, err := h.UploadSessions.Take(uploadId)
+	if err != nil {
+		return nil, utils.SendError(c, fiber.StatusBadRequest, err.Error())
+	}
+
+	if session.UserId != claims.UserId {
+		return nil, utils.SendError(c, fiber.StatusForbidden, "Upload session belongs to another user")
+	}
+	if session.Category != category || session.GroupId != c.Params("groupId") {
+		return nil, utils.SendError(c, fiber.StatusBadRequest, "Upload does not match its session")
+	}
+
+	filename, _ := utils.DecodeURIComponent(c.Get("File-Name"))
+	if filename != session.Filename || string(c.Request().Header.ContentType()) != session.MimeType {
+		return nil, utils.SendError(c, fiber.StatusBadRequest, "Upload does not match its session")
+	}
+	if int64(c.Request().Header.ContentLength()) != session.Size {
+		return nil, utils.SendError(c, fiber.StatusBadRequest, "Upload size does not match its session")
+	}
+
+	return session, nil
+}
+
+// checkUploadSession compares the written file with the declared size and hash.
+func checkUploadSession(c fiber.Ctx, session *utils.UploadSession, pendingFile *utils.PendingFile) error {
+	if int64(pendingFile.FileSize) != session.Size {
+		return utils.SendError(c, fiber.StatusBadRequest, "Upload size does not match its session")
+	}
+	if session.Sha256 != "" && pendingFile.Sha256 != session.Sha256 {
+		return utils.SendError(c, fiber.StatusBadRequest, "Upload hash does not match its session")
+	}
+	return nil
+}
@@ -0,0 +1,140 @@
+package handlers
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/gofiber/fiber/v3"
+)
+
+func initUpload(t *testing.T, app *fiber.App, token string, request InitUploadRequest) string {
+	t.Helper()
+
+	body, _ := json.Marshal(request)
+	req := httptest.NewRequest(http.MethodPost, "/uploads/init", strings.NewReader(string(body)))
+	req.Header.Set("Authorization", token)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp := testRequest(t, app, req)
+	data, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != fiber.StatusOK {
+		t.Fatalf("init status = %d: %s", resp.StatusCode, data)
+	}
+	var result struct {
+		UploadId string `json:"uploadId"`
+	}
+	if err := json.Unmarshal(data, &result); err != nil {
+		t.Fatal(err)
+	}
+	return result.UploadId
+}
+
+func TestUploadSessions(t *testing.T) {
+	content := "hello world"
+	sum := sha256.Sum256([]byte(content))
+	declared := InitUploadRequest{
+		Category: "attachments",
+		GroupId:  "99",
+		Filename: "notes.txt",
+		Size:     int64(len(content)),
+		MimeType: "text/plain",
+		Sha256:   hex.EncodeToString(sum[:]),
+	}
+
+	tests := []struct {
+		name     string
+		declared func(*InitUploadRequest)
+		path     string
+		filename string
+		mimeType string
+		body     string
+		otherId  bool
+		status   int
+	}{
+		{name: "matching upload", status: fiber.StatusOK},
+		{name: "without a hash", declared: func(r *InitUploadRequest) { r.Sha256 = "" }, status: fiber.StatusOK},
+		{name: "other group", path: "/attachments/98", status: fiber.StatusBadRequest},
+		{name: "other filename", filename: "other.txt", status: fiber.StatusBadRequest},
+		{name: "other content type", mimeType: "application/octet-stream", status: fiber.StatusBadRequest},
+		{name: "other size", body: "hello", status: fiber.StatusBadRequest},
+		{name: "other content", body: "HELLO WORLD", status: fiber.StatusBadRequest},
+		{name: "unknown session", otherId: true, status: fiber.StatusBadRequest},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, app, token := newTestUploadHandler(t)
+
+			request := declared
+			if test.declared != nil {
+				test.declared(&request)
+			}
+			uploadId := initUpload(t, app, token, request)
+			if test.otherId {
+				id, _ := strconv.ParseInt(uploadId, 10, 64)
+				uploadId = strconv.FormatInt(id+1, 10)
+			}
+
+			path, filename, mimeType, body := "/attachments/99", "notes.txt", "text/plain", content
+			if test.path != "" {
+				path = test.path
+			}
+			if test.filename != "" {
+				filename = test.filename
+			}
+			if test.mimeType != "" {
+				mimeType = test.mimeType
+			}
+			if test.body != "" {
+				body = test.body
+			}
+
+			req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+			req.Header.Set("Authorization", token)
+			req.Header.Set("Upload-Id", uploadId)
+			req.Header.Set("File-Name", filename)
+			req.Header.Set("Content-Type", mimeType)
+
+			resp := testRequest(t, app, req)
+			if resp.StatusCode != test.status {
+				data, _ := io.ReadAll(resp.Body)
+				t.Fatalf("status = %d, want %d: %s", resp.StatusCode, test.status, data)
+			}
+
+			// A session is used up by the first upload that names it, whether it matched or not.
+			req = httptest.NewRequest(http.MethodPost, "/attachments/99", strings.NewReader(content))
+			req.Header.Set("Authorization", token)
+			req.Header.Set("Upload-Id", uploadId)
+			req.Header.Set("File-Name", "notes.txt")
+			req.Header.Set("Content-Type", "text/plain")
+			if resp := testRequest(t, app, req); resp.StatusCode != fiber.StatusBadRequest {
+				t.Errorf("second upload with the session: status = %d, want %d", resp.StatusCode, fiber.StatusBadRequest)
+			}
+		})
+	}
+}
+
+func TestUploadSessionOtherUser(t *testing.T) {
+	h, app, token := newTestUploadHandler(t)
+	uploadId := initUpload(t, app, token, InitUploadRequest{Category: "attachments", GroupId: "99", Filename: "notes.txt", Size: 5, MimeType: "text/plain"})
+
+	otherToken, err := h.Jwt.GenerateToken(testUserId + 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest(http.MethodPost, "/attachments/99", strings.NewReader("hello"))
+	req.Header.Set("Authorization", otherToken)
+	req.Header.Set("Upload-Id", uploadId)
+	req.Header.Set("File-Name", "notes.txt")
+	req.Header.Set("Content-Type", "text/plain")
+	if resp := testRequest(t, app, req); resp.StatusCode != fiber.StatusForbidden {
+		t.Errorf("status = %d, want %d", resp.StatusCode, fiber.StatusForbidden)
+	}
+}
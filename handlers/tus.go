@@ -0,0 +1,295 @@
+package handlers
+
+import (
+	"cdn_nerimity_go/security"
+	"cdn_nerimity_go/utils"
+	"encoding/base64"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v3"
+)
+
+// Resumable attachment uploads using the tus 1.0 protocol (core, creation and termination).
+// https://tus.io/protocols/resumable-upload
+
+const TusVersion = "1.0.0"
+const TusExtensions = "creation,termination"
+
+func setTusHeaders(c fiber.Ctx) {
+	c.Set("Tus-Resumable", TusVersion)
+	c.Set("Cache-Control", "no-store")
+}
+
+func checkTusResumable(c fiber.Ctx) error {
+	if c.Get("Tus-Resumable") != TusVersion {
+		c.Set("Tus-Version", TusVersion)
+		return utils.SendError(c, fiber.StatusPreconditionFailed, "Unsupported tus version")
+	}
+	return nil
+}
+
+func parseTusMetadata(header string) map[string]string {
+	metadata := map[string]string{}
+	for _, pair := range strings.Split(header, ",") {
+		parts := strings.SplitN(strings.TrimSpace(pair), " ", 2)
+		if parts[0] == "" {
+			continue
+		}
+		if len(parts) == 1 {
+			metadata[parts[0]] = ""
+			continue
+		}
+		value, err := base64.StdEncoding.DecodeString(parts[1])
+		if err != nil {
+			continue
+		}
+		metadata[parts[0]] = string(value)
+	}
+	return metadata
+}
+
+func getTusUpload(c fiber.Ctx, h *UploadHandler) (*utils.TusUpload, *security.Claims, error) {
+	claims, err := auth(c, h)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	uploadId, err := strconv.ParseInt(c.Params("uploadId"), 10, 64)
+	if err != nil {
+		return nil, nil, utils.SendError(c, fiber.StatusNotFound, "Upload not found")
+	}
+
+	upload, err := h.TusUploadsManager.Get(uploadId)
+	if err != nil {
+		return nil, nil, utils.SendError(c, fiber.StatusNotFound, err.Error())
+	}
+
+	if strconv.FormatInt(upload.UserId, 10) != claims.UserId {
+		return nil, nil, utils.SendError(c, fiber.StatusForbidden, "Forbidden")
+	}
+	return upload, claims, nil
+}
+
+func (h *UploadHandler) TusCreate(c fiber.Ctx) error {
+	setTusHeaders(c)
+	if err := checkTusResumable(c); err != nil {
+		return err
+	}
+
+	claims, err := auth(c, h)
+	if err != nil {
+		return err
+	}
+
+	groupId, err := strconv.ParseInt(c.Params("groupId"), 10, 64)
+	if err != nil {
+		return utils.SendError(c, fiber.StatusBadRequest, "Invalid group id")
+	}
+	err = checkCredentialScope(c, claims, utils.AttachmentsCategory, c.Params("groupId"))
+	if err != nil {
+		return err
+	}
+
+	release, err := handleRateLimit(c, h, utils.AttachmentsCategory, claims, 1, 0)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	length, err := strconv.ParseInt(c.Get("Upload-Length"), 10, 64)
+	if err != nil || length <= 0 {
+		return utils.SendError(c, fiber.StatusBadRequest, "Invalid upload length")
+	}
+	if length > h.Env.UploadPolicy(string(utils.AttachmentsCategory)).MaxBytes {
+		return utils.SendError(c, fiber.StatusRequestEntityTooLarge, "File too large")
+	}
+
+	metadata := parseTusMetadata(c.Get("Upload-Metadata"))
+	filename := utils.SafeFilename(metadata["filename"])
+
+	uploadId := h.Flake.Generate()
+	file, err := utils.CreatePartial("temp")
+	if err != nil {
+		return utils.SendError(c, fiber.StatusInternalServerError, "Failed to create file")
+	}
+	filePath := file.Name()
+	file.Close()
+
+	upload := utils.TusUpload{
+		UploadId:  uploadId,
+		GroupId:   groupId,
+		Filename:  filename,
+		MimeType:  metadata["filetype"],
+		Path:      filePath,
+		Length:    length,
+		ExpiresAt: time.Now().Add(utils.TusUploadExpiry),
+	}
+	upload.UserId, _ = strconv.ParseInt(claims.UserId, 10, 64)
+	h.TusUploadsManager.Add(&upload)
+
+	c.Set("Location", c.Path()+"/"+strconv.FormatInt(uploadId, 10))
+	return c.SendStatus(fiber.StatusCreated)
+}
+
+func (h *UploadHandler) TusHead(c fiber.Ctx) error {
+	setTusHeaders(c)
+	if err := checkTusResumable(c); err != nil {
+		return err
+	}
+
+	upload, _, err := getTusUpload(c, h)
+	if err != nil {
+		return err
+	}
+
+	c.Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+	c.Set("Upload-Length", strconv.FormatInt(upload.Length, 10))
+	if upload.FileId != 0 {
+		c.Set("File-Id", strconv.FormatInt(upload.FileId, 10))
+	}
+	return c.SendStatus(fiber.StatusOK)
+}
+
+func (h *UploadHandler) TusPatch(c fiber.Ctx) error {
+	setTusHeaders(c)
+	if err := checkTusResumable(c); err != nil {
+		return err
+	}
+
+	if string(c.Request().Header.ContentType()) != "application/offset+octet-stream" {
+		return utils.SendError(c, fiber.StatusUnsupportedMediaType, "Invalid content type")
+	}
+
+	upload, claims, err := getTusUpload(c, h)
+	if err != nil {
+		return err
+	}
+
+	// Chunks only count towards the byte and concurrency limits, the upload was counted as a request when it was created.
+	release, err := handleRateLimit(c, h, utils.AttachmentsCategory, claims, 0, int64(c.Request().Header.ContentLength()))
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	upload, err = h.TusUploadsManager.Acquire(upload.UploadId)
+	if err != nil {
+		return utils.SendError(c, fiber.StatusConflict, err.Error())
+	}
+	defer h.TusUploadsManager.Release(upload)
+
+	offset, err := strconv.ParseInt(c.Get("Upload-Offset"), 10, 64)
+	if err != nil || offset != upload.Offset {
+		return utils.SendError(c, fiber.StatusConflict, "Upload offset mismatch")
+	}
+	if upload.FileId != 0 {
+		return utils.SendError(c, fiber.StatusConflict, "Upload already finished")
+	}
+
+	file, err := os.OpenFile(upload.Path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return utils.SendError(c, fiber.StatusInternalServerError, "Failed to open file")
+	}
+
+	buf := make([]byte, 1024*1024)
+	limitSrc := io.LimitReader(uploadBody(c, h), upload.Length-upload.Offset)
+	written, copyErr := io.CopyBuffer(struct{ io.Writer }{file}, limitSrc, buf)
+	file.Close()
+
+	// Whatever made it to disk before a dropped connection still counts, so the client can resume from there.
+	upload.Offset += written
+	if errors.Is(copyErr, utils.ErrUploadStalled) {
+		return abortStalledUpload(c, written)
+	}
+	if copyErr != nil {
+		return utils.SendError(c, fiber.StatusInternalServerError, "Failed to write file")
+	}
+
+	c.Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+
+	if upload.Offset < upload.Length {
+		return c.SendStatus(fiber.StatusNoContent)
+	}
+
+	pendingFile, err := finishTusUpload(c, h, upload)
+	if err != nil {
+		h.TusUploadsManager.Discard(upload.UploadId)
+		return err
+	}
+	upload.FileId = pendingFile.FileId
+	upload.Path = pendingFile.Path
+
+	c.Set("File-Id", strconv.FormatInt(pendingFile.FileId, 10))
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+func finishTusUpload(c fiber.Ctx, h *UploadHandler, upload *utils.TusUpload) (*utils.PendingFile, error) {
+	ext := filepath.Ext(upload.Filename)
+	filePath := "temp/" + strconv.FormatInt(upload.UploadId, 10) + ext
+
+	err := utils.CommitFile(upload.Path, filePath)
+	if err != nil {
+		// The upload is discarded, so neither the partial file nor a renamed but unsynced copy is needed.
+		os.Remove(upload.Path)
+		os.Remove(filePath)
+		return nil, utils.SendError(c, fiber.StatusInternalServerError, "Failed to finish upload")
+	}
+	upload.Path = filePath
+
+	hash, err := utils.HashFile(filePath)
+	if err != nil {
+		os.Remove(filePath)
+		return nil, utils.SendError(c, fiber.StatusInternalServerError, "Failed to hash file")
+	}
+
+	pendingFile := &utils.PendingFile{
+		Filename:         filepath.Base(filePath),
+		OriginalFilename: upload.Filename,
+		FileId:           upload.UploadId,
+		GroupId:          upload.GroupId,
+		UserId:           upload.UserId,
+		Path:             filePath,
+		Type:             utils.AttachmentsCategory,
+		MimeType:         upload.MimeType,
+		FileSize:         int(upload.Length),
+		Sha256:           hash,
+	}
+
+	isImage, isAudioOrVideo, err := handleSniff(c, h, pendingFile, upload.MimeType)
+	if err == nil {
+		err = processPendingFile(c, h, pendingFile, isImage, isAudioOrVideo)
+	}
+	if err != nil {
+		os.Remove(pendingFile.Path)
+		return nil, err
+	}
+	return pendingFile, nil
+}
+
+func (h *UploadHandler) TusDelete(c fiber.Ctx) error {
+	setTusHeaders(c)
+	if err := checkTusResumable(c); err != nil {
+		return err
+	}
+
+	upload, _, err := getTusUpload(c, h)
+	if err != nil {
+		return err
+	}
+
+	upload, err = h.TusUploadsManager.Remove(upload.UploadId)
+	if err != nil {
+		return utils.SendError(c, fiber.StatusConflict, err.Error())
+	}
+	if upload.FileId == 0 {
+		os.Remove(upload.Path)
+	}
+
+	return c.SendStatus(fiber.StatusNoContent)
+}
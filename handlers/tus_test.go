@@ -0,0 +1,216 @@
+package handlers
+
+import (
+	"cdn_nerimity_go/config"
+	"cdn_nerimity_go/security"
+	"cdn_nerimity_go/utils"
+	"encoding/base64"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/gofiber/fiber/v3"
+)
+
+const testUserId = 1234
+
+// newTestUploadHandler serves the upload routes from a fresh temp directory, with a token for testUserId.
+func newTestUploadHandler(t *testing.T) (*UploadHandler, *fiber.App, string) {
+	t.Helper()
+
+	t.Chdir(t.TempDir())
+	t.Setenv("JWT_SECRET", "test secret")
+	t.Setenv("EXTERNAL_EMBED_SECRET", "test secret")
+	t.Setenv("INTERNAL_SECRET", "test secret")
+
+	env := config.LoadConfig()
+	jwt := security.NewJWTService(env.JwtSecret)
+	token, err := jwt.GenerateToken(testUserId)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h := NewUploadHandler(&UploadHandler{
+		Env:               env,
+		Flake:             utils.NewFlake(),
+		Jwt:               jwt,
+		PendingStore:      utils.NewPendingFilesManager(),
+		TusUploadsManager: utils.NewTusUploadsManager(),
+		RateLimiter:       utils.NewRateLimiter(),
+		UploadSessions:    utils.NewUploadSessionsManager(),
+	})
+
+	app := fiber.New(fiber.Config{StreamRequestBody: true})
+	app.Post("/attachments/:groupId/tus", h.TusCreate)
+	app.Head("/attachments/:groupId/tus/:uploadId", h.TusHead)
+	app.Patch("/attachments/:groupId/tus/:uploadId", h.TusPatch)
+	app.Delete("/attachments/:groupId/tus/:uploadId", h.TusDelete)
+	app.Post("/attachments/:groupId", h.UploadFile)
+	app.Post("/uploads/init", h.InitUpload)
+	return h, app, token
+}
+
+func testRequest(t *testing.T, app *fiber.App, req *http.Request) *http.Response {
+	t.Helper()
+
+	resp, err := app.Test(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+func createTusUpload(t *testing.T, app *fiber.App, token string, length int) string {
+	t.Helper()
+
+	req := httptest.NewRequest(http.MethodPost, "/attachments/99/tus", nil)
+	req.Header.Set("Authorization", token)
+	req.Header.Set("Tus-Resumable", TusVersion)
+	req.Header.Set("Upload-Length", strconv.Itoa(length))
+	req.Header.Set("Upload-Metadata", "filename "+base64.StdEncoding.EncodeToString([]byte("notes.txt"))+",filetype "+base64.StdEncoding.EncodeToString([]byte("text/plain")))
+
+	resp := testRequest(t, app, req)
+	if resp.StatusCode != fiber.StatusCreated {
+		body, _ := io.ReadAll(resp.Body)
+		t.Fatalf("create status = %d: %s", resp.StatusCode, body)
+	}
+	location := resp.Header.Get("Location")
+	if !strings.HasPrefix(location, "/attachments/99/tus/") {
+		t.Fatalf("Location = %q", location)
+	}
+	return location
+}
+
+func patchTusUpload(t *testing.T, app *fiber.App, token string, location string, offset string, contentType string, body string) *http.Response {
+	t.Helper()
+
+	req := httptest.NewRequest(http.MethodPatch, location, strings.NewReader(body))
+	req.Header.Set("Authorization", token)
+	req.Header.Set("Tus-Resumable", TusVersion)
+	req.Header.Set("Content-Type", contentType)
+	if offset != "" {
+		req.Header.Set("Upload-Offset", offset)
+	}
+	return testRequest(t, app, req)
+}
+
+func TestTusOffsets(t *testing.T) {
+	h, app, token := newTestUploadHandler(t)
+	location := createTusUpload(t, app, token, len("hello world"))
+
+	steps := []struct {
+		name        string
+		offset      string
+		contentType string
+		body        string
+		status      int
+		wantOffset  string
+	}{
+		{name: "first chunk", offset: "0", body: "hello", status: fiber.StatusNoContent, wantOffset: "5"},
+		{name: "offset behind", offset: "0", body: " world", status: fiber.StatusConflict},
+		{name: "offset ahead", offset: "7", body: "rld", status: fiber.StatusConflict},
+		{name: "offset missing", body: " world", status: fiber.StatusConflict},
+		{name: "offset not a number", offset: "five", body: " world", status: fiber.StatusConflict},
+		{name: "wrong content type", offset: "5", contentType: "text/plain", body: " world", status: fiber.StatusUnsupportedMediaType},
+		{name: "last chunk is cut at the upload length", offset: "5", body: " world and more", status: fiber.StatusNoContent, wantOffset: "11"},
+		{name: "finished", offset: "11", body: "more", status: fiber.StatusConflict},
+	}
+
+	for _, step := range steps {
+		contentType := step.contentType
+		if contentType == "" {
+			contentType = "application/offset+octet-stream"
+		}
+		resp := patchTusUpload(t, app, token, location, step.offset, contentType, step.body)
+		if resp.StatusCode != step.status {
+			body, _ := io.ReadAll(resp.Body)
+			t.Fatalf("%s: status = %d, want %d: %s", step.name, resp.StatusCode, step.status, body)
+		}
+		if step.wantOffset != "" && resp.Header.Get("Upload-Offset") != step.wantOffset {
+			t.Fatalf("%s: Upload-Offset = %q, want %q", step.name, resp.Header.Get("Upload-Offset"), step.wantOffset)
+		}
+	}
+
+	req := httptest.NewRequest(http.MethodHead, location, nil)
+	req.Header.Set("Authorization", token)
+	req.Header.Set("Tus-Resumable", TusVersion)
+	resp := testRequest(t, app, req)
+	if resp.Header.Get("Upload-Offset") != "11" || resp.Header.Get("Upload-Length") != "11" {
+		t.Errorf("HEAD offset %q of %q, want 11 of 11", resp.Header.Get("Upload-Offset"), resp.Header.Get("Upload-Length"))
+	}
+
+	fileId, err := strconv.ParseInt(resp.Header.Get("File-Id"), 10, 64)
+	if err != nil {
+		t.Fatalf("HEAD File-Id = %q", resp.Header.Get("File-Id"))
+	}
+	pendingFile, err := h.PendingStore.Get(fileId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(pendingFile.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "hello world" || pendingFile.FileSize != 11 || pendingFile.UserId != testUserId {
+		t.Errorf("pending file %q, %d bytes, user %d", data, pendingFile.FileSize, pendingFile.UserId)
+	}
+}
+
+func TestTusOtherUser(t *testing.T) {
+	h, app, token := newTestUploadHandler(t)
+	location := createTusUpload(t, app, token, 5)
+
+	otherToken, err := h.Jwt.GenerateToken(testUserId + 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp := patchTusUpload(t, app, otherToken, location, "0", "application/offset+octet-stream", "hello")
+	if resp.StatusCode != fiber.StatusForbidden {
+		t.Errorf("status = %d, want %d", resp.StatusCode, fiber.StatusForbidden)
+	}
+}
+
+func TestTusDelete(t *testing.T) {
+	h, app, token := newTestUploadHandler(t)
+	location := createTusUpload(t, app, token, 11)
+	if resp := patchTusUpload(t, app, token, location, "0", "application/offset+octet-stream", "hello"); resp.StatusCode != fiber.StatusNoContent {
+		t.Fatalf("patch status = %d", resp.StatusCode)
+	}
+
+	uploadId, _ := strconv.ParseInt(location[strings.LastIndex(location, "/")+1:], 10, 64)
+	upload, err := h.TusUploadsManager.Get(uploadId)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodDelete, location, nil)
+	req.Header.Set("Authorization", token)
+	req.Header.Set("Tus-Resumable", TusVersion)
+	if resp := testRequest(t, app, req); resp.StatusCode != fiber.StatusNoContent {
+		t.Fatalf("delete status = %d", resp.StatusCode)
+	}
+	if _, err := os.Stat(upload.Path); !os.IsNotExist(err) {
+		t.Errorf("partial file was kept: %v", err)
+	}
+	if resp := patchTusUpload(t, app, token, location, "5", "application/offset+octet-stream", " world"); resp.StatusCode != fiber.StatusNotFound {
+		t.Errorf("patch after delete status = %d, want %d", resp.StatusCode, fiber.StatusNotFound)
+	}
+}
+
+func TestParseTusMetadata(t *testing.T) {
+	metadata := parseTusMetadata("filename bm90ZXMudHh0, is_confidential, filetype dGV4dC9wbGFpbg==, broken !!!")
+	want := map[string]string{"filename": "notes.txt", "is_confidential": "", "filetype": "text/plain"}
+	if len(metadata) != len(want) {
+		t.Fatalf("parseTusMetadata = %v, want %v", metadata, want)
+	}
+	for key, value := range want {
+		if metadata[key] != value {
+			t.Errorf("metadata[%q] = %q, want %q", key, metadata[key], value)
+		}
+	}
+}
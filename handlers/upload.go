@@ -1,52 +1,61 @@
 package handlers
 
 import (
+	"bytes"
 	"cdn_nerimity_go/config"
+	"cdn_nerimity_go/database"
 	"cdn_nerimity_go/security"
 	"cdn_nerimity_go/utils"
 	"context"
-	"fmt"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"io"
+	"log"
 	"math"
-	"net/http"
 	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
-	"github.com/cshum/vipsgen/vips"
 	"github.com/gofiber/fiber/v3"
 	"gopkg.in/vansante/go-ffprobe.v2"
 )
 
 type UploadHandler struct {
-	Env                 *config.Config
-	Flake               *utils.Flake
-	Jwt                 *security.JWTService
-	PendingFilesManager *utils.PendingFilesManager
+	Env               *config.Config
+	Flake             *utils.Flake
+	Jwt               *security.JWTService
+	PendingStore      utils.PendingStore
+	TusUploadsManager *utils.TusUploadsManager
+	ImageProcessor    utils.ImageProcessor
+	Scanner           utils.Scanner
+	RateLimiter       *utils.RateLimiter
+	UploadSessions    *utils.UploadSessionsManager
+	Database          *database.DatabaseService
+
+	// earlyRejections holds the errors found by HeaderReceived, keyed by request header.
+	// The header is embedded in a pooled fasthttp.RequestCtx, so the same pointer comes back for later
+	// requests. That is safe because a RequestCtx serves one request at a time: HeaderReceived and the
+	// handler of a request see the same header, and no other request can use it in between.
+	earlyRejections sync.Map
 }
 
 func NewUploadHandler(context *UploadHandler) *UploadHandler {
 	return context
 }
 
-const MaxUploadSize = 50 * 1024 * 1024
-const MaxImageSize = 12 * 1024 * 1024
-
 func (h *UploadHandler) UploadFile(c fiber.Ctx) error {
-	rawFilename := c.Get("File-Name")
-	var filename, err = utils.DecodeURIComponent(rawFilename)
-	if err != nil {
-		return utils.SendError(c, fiber.StatusBadRequest, "Invalid file name")
+	if err := takeEarlyRejection(c, h); err != nil {
+		return err
 	}
 
 	groupId := c.Params("groupId")
 	fileContentType := string(c.Request().Header.ContentType())
 
-	isImage := utils.IsImage(filepath.Ext(filename)) && utils.IsMimeImage(fileContentType)
-	isAudioOrVideo := utils.IsAudioOrVideo(filepath.Ext(filename)) && utils.IsMimeAudioOrVideo(fileContentType)
-
 	claims, err := auth(c, h)
 	if err != nil {
 		return err
@@ -56,19 +65,50 @@ func (h *UploadHandler) UploadFile(c fiber.Ctx) error {
 	if err != nil {
 		return err
 	}
-	var finalPath string
+
+	attachmentCategory := utils.FileCategory(strings.ToLower(strings.Split(c.Path(), "/")[1]))
+	err = checkCredentialScope(c, claims, attachmentCategory, groupId)
+	if err != nil {
+		return err
+	}
+
+	// Rate limited before the session is taken, a 429 must not use up the session.
+	release, err := handleRateLimit(c, h, attachmentCategory, claims, 1, int64(c.Request().Header.ContentLength()))
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	session, err := takeUploadSession(c, h, claims, attachmentCategory)
+	if err != nil {
+		return err
+	}
+
+	if strings.HasPrefix(fileContentType, fiber.MIMEMultipartForm) {
+		if session != nil {
+			return utils.SendError(c, fiber.StatusBadRequest, "Upload sessions only support a single file")
+		}
+		return handleMultipartUpload(c, h, claims)
+	}
+
+	var pendingFile *utils.PendingFile
 	success := false
 	defer func() {
-		if !success && finalPath != "" {
-			os.Remove(finalPath)
+		if !success && pendingFile != nil {
+			os.Remove(pendingFile.Path)
 		}
 	}()
 
-	pendingFile, err := handleUpload(c, h)
+	pendingFile, err = handleUpload(c, h)
 	if err != nil {
 		return err
 	}
-	finalPath = pendingFile.Path
+	if session != nil {
+		err = checkUploadSession(c, session, pendingFile)
+		if err != nil {
+			return err
+		}
+	}
 	if groupId != "" {
 		pendingFile.GroupId, _ = strconv.ParseInt(groupId, 10, 64)
 
@@ -77,9 +117,43 @@ func (h *UploadHandler) UploadFile(c fiber.Ctx) error {
 		pendingFile.UserId, _ = strconv.ParseInt(claims.UserId, 10, 64)
 	}
 
-	shouldCompressImage := isImage && pendingFile.FileSize <= MaxImageSize
+	isImage, isAudioOrVideo, err := handleSniff(c, h, pendingFile, fileContentType)
+	if err != nil {
+		return err
+	}
+
+	err = processPendingFile(c, h, pendingFile, isImage, isAudioOrVideo)
+	if err != nil {
+		return err
+	}
+	success = true
+	return c.JSON(fiber.Map{
+		"fileId": strconv.FormatInt(pendingFile.FileId, 10),
+	})
+
+}
+
+// processPendingFile runs the compression and metadata steps on a file that has been fully
+// written to temp/ and hands it over to the PendingStore.
+func processPendingFile(c fiber.Ctx, h *UploadHandler, pendingFile *utils.PendingFile, isImage bool, isAudioOrVideo bool) error {
+	policy := h.Env.UploadPolicy(string(pendingFile.Type))
+	if policy == nil {
+		return utils.SendError(c, fiber.StatusBadRequest, "Invalid category")
+	}
+	shouldCompressImage := isImage && int64(pendingFile.FileSize) <= policy.CompressMaxBytes
+
+	err := handleScan(c, h, pendingFile)
+	if err != nil {
+		return err
+	}
 
 	imageCompressed := false
+	if isImage {
+		err = handleImageLimits(c, policy, pendingFile)
+		if err != nil {
+			return err
+		}
+	}
 	if shouldCompressImage {
 		imageCompressed, err = handleCompressImage(c, h, pendingFile)
 		if err != nil {
@@ -88,6 +162,11 @@ func (h *UploadHandler) UploadFile(c fiber.Ctx) error {
 	}
 
 	if isAudioOrVideo {
+		err = handleRemuxVideo(c, h, pendingFile)
+		if err != nil {
+			return err
+		}
+
 		duration, err := getMediaDuration(pendingFile.Path)
 		if err == nil {
 			pendingFile.Duration = duration
@@ -95,47 +174,152 @@ func (h *UploadHandler) UploadFile(c fiber.Ctx) error {
 	}
 
 	if imageCompressed {
-		finalPath = pendingFile.Path
 		err = handleImageMetadata(c, pendingFile)
 		if err != nil {
 			return err
 		}
 	}
 
-	pendingFile.ExpiresAt = time.Now().Add(1 * time.Minute)
-	h.PendingFilesManager.Add(pendingFile)
-	success = true
-	return c.JSON(fiber.Map{
-		"fileId": strconv.FormatInt(pendingFile.FileId, 10),
-	})
+	// Images that were not re-encoded still carry the EXIF data of the camera.
+	if isImage && !imageCompressed {
+		err = handleStripMetadata(c, h, pendingFile)
+		if err != nil {
+			return err
+		}
+	}
 
+	pendingFile.CreatedAt = time.Now()
+	pendingFile.ExpiresAt = pendingFile.CreatedAt.Add(policy.PendingTTL())
+	err = h.PendingStore.Add(pendingFile)
+	if err != nil {
+		log.Printf("Failed to store pending file %d: %v", pendingFile.FileId, err)
+		return utils.SendError(c, fiber.StatusInternalServerError, "Failed to store pending file")
+	}
+	return nil
 }
+
 func handleImageMetadata(c fiber.Ctx, pendingFile *utils.PendingFile) error {
 	pendingFile.ImageCompressed = true
-	image, err := vips.NewImageFromFile(pendingFile.Path, nil)
+	header, err := utils.ProbeImage(pendingFile.Path)
 	if err != nil {
 		return utils.SendError(c, fiber.StatusInternalServerError, "Failed to open image")
 	}
-	defer image.Close()
 	fileInfo, err := os.Stat(pendingFile.Path)
 	if err != nil {
 		return utils.SendError(c, fiber.StatusInternalServerError, "Failed to get file info")
 	}
 	pendingFile.Filename = filepath.Base(pendingFile.Path)
-	pendingFile.Height = image.Height()
-	pendingFile.Width = image.Width()
-	pendingFile.Animated = image.Pages() > 1
+	pendingFile.Height = header.Height
+	pendingFile.Width = header.Width
+	pendingFile.Animated = header.Frames > 1
 	pendingFile.FileSize = int(fileInfo.Size())
 	pendingFile.MimeType = "image/webp"
 
+	// The compressed file is what gets stored, so it is what has to be deduplicated.
+	pendingFile.Sha256, err = utils.HashFile(pendingFile.Path)
+	if err != nil {
+		return utils.SendError(c, fiber.StatusInternalServerError, "Failed to hash file")
+	}
+
+	return nil
+}
+
+// handleScan runs the configured scanner over the file as it was uploaded.
+func handleScan(c fiber.Ctx, h *UploadHandler, pendingFile *utils.PendingFile) error {
+	if h.Scanner == nil {
+		return nil
+	}
+
+	result, err := h.Scanner.Scan(pendingFile.Path)
+	if err != nil {
+		log.Printf("Failed to scan file %d: %v", pendingFile.FileId, err)
+		if !h.Env.ScannerFailOpen {
+			return utils.SendError(c, fiber.StatusServiceUnavailable, "Failed to scan file")
+		}
+		pendingFile.ScanStatus = utils.ScanStatusUnscanned
+		return nil
+	}
+
+	if result.Status == utils.ScanStatusInfected {
+		log.Printf("Rejected infected file %d from user %d: %s", pendingFile.FileId, pendingFile.UserId, result.Signature)
+		return utils.SendError(c, fiber.StatusBadRequest, "File was flagged by the malware scanner")
+	}
+
+	pendingFile.ScanStatus = result.Status
+	return nil
+}
+
+// handleImageLimits rejects images that are too large to decode safely, using only their header.
+// Images libvips can't read the header of are rejected too, the limits could not be checked for them.
+// The size is also recorded as the original size of the image, before it is resized.
+// HEIC, AVIF and JPEG XL clients can't read it themselves once the file has been converted to WebP.
+func handleImageLimits(c fiber.Ctx, policy *config.UploadPolicy, pendingFile *utils.PendingFile) error {
+	header, err := utils.ProbeImage(pendingFile.Path)
+	if err != nil {
+		return utils.SendError(c, fiber.StatusBadRequest, "Invalid image")
+	}
+
+	err = utils.ImageLimits{MaxPixels: policy.MaxPixels, MaxFrames: policy.MaxFrames}.Check(header)
+	if err != nil {
+		return utils.SendError(c, fiber.StatusBadRequest, err.Error())
+	}
+
+	pendingFile.OriginalWidth = header.Width
+	pendingFile.OriginalHeight = header.Height
+	return nil
+}
+
+// handleRemuxVideo strips the metadata of MP4 and WebM files and moves the MP4 index to the front.
+// A failed remux is not fatal, the file is stored as it was uploaded.
+func handleRemuxVideo(c fiber.Ctx, h *UploadHandler, pendingFile *utils.PendingFile) error {
+	if h.Env.VideoRemuxTimeout <= 0 || !utils.CanRemuxVideo(pendingFile.Path) {
+		return nil
+	}
+
+	err := utils.RemuxVideo(pendingFile.Path, h.Env.VideoRemuxTimeout)
+	if err != nil {
+		log.Printf("Failed to remux video %d, keeping the original: %v", pendingFile.FileId, err)
+		return nil
+	}
+
+	fileInfo, err := os.Stat(pendingFile.Path)
+	if err != nil {
+		return utils.SendError(c, fiber.StatusInternalServerError, "Failed to get file info")
+	}
+	pendingFile.FileSize = int(fileInfo.Size())
+
+	pendingFile.Sha256, err = utils.HashFile(pendingFile.Path)
+	if err != nil {
+		return utils.SendError(c, fiber.StatusInternalServerError, "Failed to hash file")
+	}
+	return nil
+}
+
+func handleStripMetadata(c fiber.Ctx, h *UploadHandler, pendingFile *utils.PendingFile) error {
+	err := utils.StripMetadata(pendingFile.Path, utils.ParseMetadataKeep(h.Env.MetadataKeep))
+	if err != nil {
+		return utils.SendError(c, fiber.StatusBadRequest, "Failed to strip image metadata")
+	}
+
+	fileInfo, err := os.Stat(pendingFile.Path)
+	if err != nil {
+		return utils.SendError(c, fiber.StatusInternalServerError, "Failed to get file info")
+	}
+	pendingFile.FileSize = int(fileInfo.Size())
+
+	pendingFile.Sha256, err = utils.HashFile(pendingFile.Path)
+	if err != nil {
+		return utils.SendError(c, fiber.StatusInternalServerError, "Failed to hash file")
+	}
 	return nil
 }
 
-func compressImage(c fiber.Ctx, filePath string, category utils.FileCategory) (string, error) {
+func compressImage(c fiber.Ctx, h *UploadHandler, filePath string, category utils.FileCategory, policy *config.UploadPolicy) (string, error) {
 	opts := utils.ImageProxyOptions{
-		Path: filePath,
+		Path:   filePath,
+		Static: !policy.AllowAnimated,
 	}
-	opts.Size = getSize(category)
+	opts.Size = getSize(policy)
 
 	if category == utils.AvatarsCategory || category == utils.ProfileBannersCategory {
 		strPoints := c.Query("points")
@@ -151,11 +335,7 @@ func compressImage(c fiber.Ctx, filePath string, category utils.FileCategory) (s
 
 	}
 
-	url, err := utils.GenerateImageProxyURL(opts)
-	if err != nil {
-		return "", err
-	}
-	newPath, err := downloadAndReplaceImage(url, filePath)
+	newPath, err := replaceImage(h.ImageProcessor, opts, filePath)
 	if err != nil {
 		return "", err
 	}
@@ -164,92 +344,71 @@ func compressImage(c fiber.Ctx, filePath string, category utils.FileCategory) (s
 
 }
 
-func getSize(category utils.FileCategory) utils.ImageProxySize {
-	size := utils.ImageProxySize{}
-
-	if category == utils.AttachmentsCategory {
-		size.Width = 1920
-		size.Height = 1080
-		size.ResizeType = utils.ResizeTypeFit
-	}
-	if category == utils.EmojisCategory {
-		size.Width = 100
-		size.Height = 100
-		size.ResizeType = utils.ResizeTypeFit
+func getSize(policy *config.UploadPolicy) utils.ImageProxySize {
+	size := utils.ImageProxySize{
+		Width:      policy.Width,
+		Height:     policy.Height,
+		ResizeType: utils.ResizeTypeFit,
 	}
-	if category == utils.AvatarsCategory {
-		size.Width = 200
-		size.Height = 200
-		size.ResizeType = utils.ResizeTypeFill
-	}
-	if category == utils.ProfileBannersCategory {
-		size.Width = 1920
-		size.Height = 1080
+
+	if policy.ResizeMode == string(utils.ResizeTypeFill) {
 		size.ResizeType = utils.ResizeTypeFill
 	}
 	return size
 }
 
-func downloadAndReplaceImage(url, oldFilePath string) (string, error) {
-	client := &http.Client{
-		Timeout: 30 * time.Second,
-	}
-
-	resp, err := client.Get(url)
-	if err != nil {
-		return "", err
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		return "", fmt.Errorf("failed to fetch: %s", resp.Status)
-	}
-
+func replaceImage(processor utils.ImageProcessor, opts utils.ImageProxyOptions, oldFilePath string) (string, error) {
 	dir := filepath.Dir(oldFilePath)
 	base := filepath.Base(oldFilePath)
 	nameWithoutExt := strings.TrimSuffix(base, filepath.Ext(base))
 	newPath := filepath.Join(dir, nameWithoutExt+".webp")
 
-	tempFile, err := os.CreateTemp(dir, "replace-*.tmp")
+	tempFile, err := utils.CreatePartial(dir)
 	if err != nil {
 		return "", err
 	}
 	tempName := tempFile.Name()
+	tempFile.Close()
 
-	defer func() {
-		tempFile.Close()
-		os.Remove(tempName)
-	}()
-
-	buffer := make([]byte, 1024*1024)
+	defer os.Remove(tempName)
 
-	_, err = io.CopyBuffer(tempFile, resp.Body, buffer)
+	err = processor.Compress(opts, tempName)
 	if err != nil {
 		return "", err
 	}
 
-	if err := tempFile.Close(); err != nil {
-		return "", err
-	}
-
 	if oldFilePath != newPath {
 		_ = os.Remove(oldFilePath)
 	}
 
-	err = os.Rename(tempName, newPath)
+	err = utils.CommitFile(tempName, newPath)
 	if err != nil {
 		return "", err
 	}
-	os.Chmod(newPath, 0644)
 	return newPath, nil
 }
 
 func auth(c fiber.Ctx, h *UploadHandler) (*security.Claims, error) {
-	token := c.Get("Authorization")
+	return verifyAuthorization(c, h, c.Get("Authorization"))
+}
+
+func verifyAuthorization(c fiber.Ctx, h *UploadHandler, token string) (*security.Claims, error) {
 	if token == "" {
 		return nil, utils.SendError(c, fiber.StatusUnauthorized, "Unauthorized")
 	}
 
+	if security.IsCredentialToken(token) {
+		credential, err := h.Database.GetUploadCredential(security.HashCredentialToken(token))
+		if err != nil {
+			log.Printf("Failed to look up upload credential: %v", err)
+			return nil, utils.SendError(c, fiber.StatusInternalServerError, "Failed to verify credential")
+		}
+		if credential == nil {
+			return nil, utils.SendError(c, fiber.StatusUnauthorized, "Unauthorized")
+		}
+		return &security.Claims{UserId: credential.UserId, Credential: credential}, nil
+	}
+
 	claims, err := h.Jwt.VerifyToken(token)
 
 	if err != nil {
@@ -259,6 +418,55 @@ func auth(c fiber.Ctx, h *UploadHandler) (*security.Claims, error) {
 
 }
 
+// checkCredentialScope rejects uploads outside of the categories and groups an upload credential is limited to.
+func checkCredentialScope(c fiber.Ctx, claims *security.Claims, category utils.FileCategory, groupId string) error {
+	if claims.Credential == nil || claims.Credential.Allows(string(category), groupId) {
+		return nil
+	}
+	return utils.SendError(c, fiber.StatusForbidden, "Credential is not allowed to upload here")
+}
+
+// handleRateLimit charges the upload to both the user and the client IP, or to the upload credential.
+// The returned release func must be called once the upload has been handled.
+func handleRateLimit(c fiber.Ctx, h *UploadHandler, category utils.FileCategory, claims *security.Claims, requests int, bytes int64) (func(), error) {
+	keys, limit := rateLimitFor(c, h, category, claims)
+
+	release, retryAfter, ok := h.RateLimiter.Acquire(keys, limit, requests, bytes)
+	if !ok {
+		return nil, sendRateLimited(c, retryAfter)
+	}
+	return release, nil
+}
+
+func rateLimitFor(c fiber.Ctx, h *UploadHandler, category utils.FileCategory, claims *security.Claims) ([]string, utils.RateLimit) {
+	rateLimit := h.Env.UploadPolicy(string(category)).RateLimit
+	keys := []string{
+		"user:" + claims.UserId + ":" + string(category),
+		"ip:" + c.IP() + ":" + string(category),
+	}
+
+	// Bots often share an IP with other bots, so a credential is only limited by its own key.
+	if claims.Credential != nil {
+		if claims.Credential.RateLimit != (config.UploadRateLimit{}) {
+			rateLimit = claims.Credential.RateLimit
+		}
+		keys = []string{"credential:" + claims.Credential.Id + ":" + string(category)}
+	}
+
+	limit := utils.RateLimit{
+		Requests:   rateLimit.Requests,
+		Bytes:      rateLimit.Bytes,
+		Window:     time.Duration(rateLimit.WindowSeconds) * time.Second,
+		Concurrent: rateLimit.Concurrent,
+	}
+	return keys, limit
+}
+
+func sendRateLimited(c fiber.Ctx, retryAfter time.Duration) error {
+	c.Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+	return utils.SendError(c, fiber.StatusTooManyRequests, "Too many uploads, try again later")
+}
+
 func validate(c fiber.Ctx, h *UploadHandler) error {
 	contentLength := c.Request().Header.ContentLength()
 	rawFilename := c.Get("File-Name")
@@ -267,22 +475,35 @@ func validate(c fiber.Ctx, h *UploadHandler) error {
 		return utils.SendError(c, fiber.StatusBadRequest, "Invalid file name")
 	}
 	fileContentType := string(c.Request().Header.ContentType())
+	isMultipart := strings.HasPrefix(fileContentType, fiber.MIMEMultipartForm)
 
 	groupId := c.Params("groupId")
 
 	attachmentCategory := utils.FileCategory(strings.ToLower(strings.Split(c.Path(), "/")[1]))
+
+	return validateDeclared(c, h, attachmentCategory, groupId, filename, fileContentType, int64(contentLength), isMultipart)
+}
+
+// validateDeclared checks what the client says it is going to upload against the category policy.
+// The type and size of each part of a multipart body is checked once it has been read.
+func validateDeclared(c fiber.Ctx, h *UploadHandler, attachmentCategory utils.FileCategory, groupId string, filename string, fileContentType string, contentLength int64, isMultipart bool) error {
 	isImage := utils.IsImage(filepath.Ext(filename)) && utils.IsMimeImage(fileContentType)
 
-	if contentLength > MaxUploadSize {
+	policy := h.Env.UploadPolicy(string(attachmentCategory))
+	if policy == nil {
+		return utils.SendError(c, fiber.StatusBadRequest, "Invalid category")
+	}
+
+	if contentLength > policy.MaxBytes {
 		return utils.SendError(c, fiber.StatusBadRequest, "File too large")
 	}
 	if contentLength <= 0 {
 		return utils.SendError(c, fiber.StatusBadRequest, "Invalid content length")
 	}
 
-	shouldCompressImage := isImage && contentLength <= MaxImageSize
-	if attachmentCategory != "attachments" {
-		if !isImage {
+	shouldCompressImage := isImage && contentLength <= policy.CompressMaxBytes
+	if attachmentCategory != "attachments" && !isMultipart {
+		if !isImage || !policy.AllowsMimeType(fileContentType) {
 			return utils.SendError(c, fiber.StatusBadRequest, "Invalid file type")
 		}
 		if !shouldCompressImage {
@@ -308,53 +529,150 @@ func handleUpload(c fiber.Ctx, h *UploadHandler) (*utils.PendingFile, error) {
 	}
 	mimeType := string(c.Request().Header.ContentType())
 
-	if strings.HasPrefix(mimeType, fiber.MIMEMultipartForm) {
-		return nil, utils.SendError(c, fiber.StatusBadRequest, "Direct binary upload expected, but multipart/form-data was sent.")
+	attachmentCategory := utils.FileCategory(strings.ToLower(strings.Split(c.Path(), "/")[1]))
+	policy := h.Env.UploadPolicy(string(attachmentCategory))
+	if policy == nil {
+		return nil, utils.SendError(c, fiber.StatusBadRequest, "Invalid category")
 	}
 
-	attachmentCategory := utils.FileCategory(strings.ToLower(strings.Split(c.Path(), "/")[1]))
+	digest, err := parseContentDigest(c, func(key string) string { return c.Get(key) })
+	if err != nil {
+		return nil, err
+	}
+
+	return writeTempFile(c, h, uploadBody(c, h), filename, mimeType, attachmentCategory, policy.MaxBytes, digest)
+}
 
+// uploadBody returns the request body, which fails with utils.ErrUploadStalled when the client sends it too slowly.
+func uploadBody(c fiber.Ctx, h *UploadHandler) *utils.UploadWatchdog {
+	return utils.NewUploadWatchdog(c.Request().BodyStream(), c.RequestCtx().Conn(), h.Env.UploadMinBytesPerSecond, h.Env.UploadStallWindow)
+}
+
+// abortStalledUpload logs an upload the watchdog gave up on.
+// The rest of the body is never read, so the connection can't be reused.
+func abortStalledUpload(c fiber.Ctx, received int64) error {
+	c.RequestCtx().SetConnectionClose()
+	log.Printf("Aborted stalled upload from %s to %s after %d bytes (%d stalled uploads so far)", c.IP(), c.Path(), received, utils.StalledUploads.Load())
+	return utils.SendError(c, fiber.StatusRequestTimeout, "Upload is too slow")
+}
+
+// writeTempFile streams src into temp/ and returns the resulting PendingFile.
+// When the client sent a digest the written bytes must match it.
+// Nothing is left behind in temp/ when it fails.
+func writeTempFile(c fiber.Ctx, h *UploadHandler, src io.Reader, filename string, mimeType string, category utils.FileCategory, maxBytes int64, digest *contentDigest) (*utils.PendingFile, error) {
 	safeFilename := utils.SafeFilename(filename)
 	ext := filepath.Ext(safeFilename)
 
 	fileId := h.Flake.Generate()
 
 	filePath := "temp/" + strconv.FormatInt(fileId, 10) + ext
-	file, err := os.Create(filePath)
+	file, err := utils.CreatePartial("temp")
 	if err != nil {
 		return nil, utils.SendError(c, fiber.StatusInternalServerError, "Failed to create file")
 	}
+	partialPath := file.Name()
 	defer file.Close()
 
-	src := c.Request().BodyStream()
+	hash := sha256.New()
+	md5Hash := md5.New()
+	writers := []io.Writer{file, hash}
+	if digest != nil && digest.Algorithm == "md5" {
+		writers = append(writers, md5Hash)
+	}
 
 	buf := make([]byte, 1024*1024)
-	limitSrc := io.LimitReader(src, MaxUploadSize+1)
-	written, err := io.CopyBuffer(struct{ io.Writer }{file}, limitSrc, buf)
+	limitSrc := io.LimitReader(src, maxBytes+1)
+	written, err := io.CopyBuffer(io.MultiWriter(writers...), limitSrc, buf)
+	if errors.Is(err, utils.ErrUploadStalled) {
+		os.Remove(partialPath)
+		return nil, abortStalledUpload(c, written)
+	}
 	if err != nil {
+		os.Remove(partialPath)
 		return nil, utils.SendError(c, fiber.StatusInternalServerError, "Failed to write file")
 	}
 
-	if written > MaxUploadSize {
+	if written > maxBytes {
+		os.Remove(partialPath)
 		return nil, utils.SendError(c, fiber.StatusBadRequest, "File exceeds size limit")
 	}
-	os.Chmod(filePath, 0644)
+
+	sum := hash.Sum(nil)
+	var digestValue string
+	if digest != nil {
+		actual := sum
+		if digest.Algorithm == "md5" {
+			actual = md5Hash.Sum(nil)
+		}
+		if !bytes.Equal(actual, digest.Value) {
+			os.Remove(partialPath)
+			return nil, utils.SendError(c, fiber.StatusBadRequest, "File does not match its "+digest.Algorithm+" digest, it may have been corrupted in transit")
+		}
+		digestValue = hex.EncodeToString(actual)
+	}
+
+	file.Close()
+	err = utils.CommitFile(partialPath, filePath)
+	if err != nil {
+		os.Remove(partialPath)
+		return nil, utils.SendError(c, fiber.StatusInternalServerError, "Failed to write file")
+	}
 
 	pendingFile := utils.PendingFile{
 		Filename:         filepath.Base(filePath),
 		OriginalFilename: safeFilename,
 		FileId:           fileId,
 		Path:             filePath,
-		Type:             attachmentCategory,
+		Type:             category,
 		MimeType:         mimeType,
 		FileSize:         int(written),
+		Sha256:           hex.EncodeToString(sum),
+	}
+	if digest != nil {
+		pendingFile.DigestAlgorithm = digest.Algorithm
+		pendingFile.Digest = digestValue
 	}
 
 	return &pendingFile, nil
 }
 
+// handleSniff replaces the client supplied mime type with the one detected from the file contents
+// and rejects files whose contents don't match their extension or declared type.
+func handleSniff(c fiber.Ctx, h *UploadHandler, pendingFile *utils.PendingFile, declaredMimeType string) (bool, bool, error) {
+	detectedMimeType, err := utils.DetectMimeType(pendingFile.Path)
+	if err != nil {
+		return false, false, utils.SendError(c, fiber.StatusInternalServerError, "Failed to read file")
+	}
+
+	ext := filepath.Ext(pendingFile.Path)
+	if !utils.MimeMatchesExtension(detectedMimeType, ext) {
+		return false, false, utils.SendError(c, fiber.StatusBadRequest, "File contents do not match its extension")
+	}
+	if utils.IsMimeImage(declaredMimeType) && !utils.IsMimeImage(detectedMimeType) {
+		return false, false, utils.SendError(c, fiber.StatusBadRequest, "File contents do not match its content type")
+	}
+	if utils.IsMimeAudioOrVideo(declaredMimeType) && !utils.IsMimeAudioOrVideo(detectedMimeType) {
+		return false, false, utils.SendError(c, fiber.StatusBadRequest, "File contents do not match its content type")
+	}
+
+	isImage := utils.IsImage(ext) && utils.IsMimeImage(detectedMimeType)
+	isAudioOrVideo := utils.IsAudioOrVideo(ext) && utils.IsMimeAudioOrVideo(detectedMimeType)
+
+	if pendingFile.Type != utils.AttachmentsCategory && !isImage {
+		return false, false, utils.SendError(c, fiber.StatusBadRequest, "Invalid file type")
+	}
+	if !h.Env.UploadPolicy(string(pendingFile.Type)).AllowsMimeType(detectedMimeType) {
+		return false, false, utils.SendError(c, fiber.StatusBadRequest, "Invalid file type")
+	}
+
+	pendingFile.MimeType = detectedMimeType
+	pendingFile.DetectedMimeType = detectedMimeType
+	return isImage, isAudioOrVideo, nil
+}
+
 func handleCompressImage(c fiber.Ctx, h *UploadHandler, pendingFile *utils.PendingFile) (bool, error) {
-	newPath, err := compressImage(c, pendingFile.Path, pendingFile.Type)
+	policy := h.Env.UploadPolicy(string(pendingFile.Type))
+	newPath, err := compressImage(c, h, pendingFile.Path, pendingFile.Type, policy)
 	if err != nil && pendingFile.Type != utils.AttachmentsCategory {
 		return false, utils.SendError(c, fiber.StatusInternalServerError, "Failed to compress image")
 	}
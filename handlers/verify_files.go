@@ -0,0 +1,124 @@
+package handlers
+
+import (
+	"cdn_nerimity_go/utils"
+	"errors"
+	"log"
+	"strconv"
+
+	"github.com/gofiber/fiber/v3"
+)
+
+const maxVerifyFiles = 100
+
+type VerifyFilesRequest struct {
+	UserId string            `json:"userId"`
+	Files  []VerifyFilesItem `json:"files"`
+	// Atomic verifies either every file or none, files that were already moved are moved back.
+	Atomic bool `json:"atomic"`
+}
+
+type VerifyFilesItem struct {
+	FileId  string `json:"fileId"`
+	GroupId string `json:"groupId"`
+}
+
+// VerifyFiles is VerifyFile for several files of the same user, e.g. the attachments of one message.
+// Responds with one result per file, in the order they were sent: the VerifyFile payload or an error.
+// In an atomic batch that failed, files that had been moved carry rolledBack to say whether they were moved back.
+func (h *InternalHandler) VerifyFiles(c fiber.Ctx) error {
+	authHeader := c.Get("Authorization")
+
+	if authHeader != h.Env.InternalSecret {
+		return utils.SendError(c, fiber.StatusUnauthorized, "Unauthorized")
+	}
+	body := new(VerifyFilesRequest)
+
+	if err := c.Bind().Body(body); err != nil {
+		return err
+	}
+
+	userId, err := strconv.ParseInt(body.UserId, 10, 64)
+	if err != nil {
+		return utils.SendError(c, fiber.StatusBadRequest, "Invalid user Id")
+	}
+	if len(body.Files) == 0 {
+		return utils.SendError(c, fiber.StatusBadRequest, "No files were sent")
+	}
+	if len(body.Files) > maxVerifyFiles {
+		return utils.SendError(c, fiber.StatusBadRequest, "Too many files")
+	}
+
+	// Ids are checked up front, so an atomic batch doesn't move anything just to fail on a typo.
+	fileIds := make([]int64, len(body.Files))
+	groupIds := make([]int64, len(body.Files))
+	for i, file := range body.Files {
+		fileIds[i], err = strconv.ParseInt(file.FileId, 10, 64)
+		if err != nil {
+			return utils.SendError(c, fiber.StatusBadRequest, "Invalid file Id")
+		}
+		if file.GroupId != "" {
+			groupIds[i], err = strconv.ParseInt(file.GroupId, 10, 64)
+			if err != nil {
+				return utils.SendError(c, fiber.StatusBadRequest, "Invalid group Id")
+			}
+		}
+	}
+
+	results := make([]fiber.Map, len(body.Files))
+	placed := make(map[int]*placedFile)
+	failed := false
+	for i := range body.Files {
+		if failed && body.Atomic {
+			results[i] = verifyFilesError(fileIds[i], "Another file in the batch failed")
+			continue
+		}
+
+		file, json, err := placePendingFile(c, h, userId, fileIds[i], groupIds[i])
+		if err != nil {
+			failed = true
+			results[i] = verifyFilesError(fileIds[i], errorMessage(err))
+			continue
+		}
+		placed[i] = file
+		results[i] = json
+	}
+
+	if !failed || !body.Atomic {
+		return c.JSON(results)
+	}
+
+	// Files that could not be moved back stay published, their result keeps the verified payload
+	// with rolledBack false and the whole response is a 500.
+	status := fiber.StatusOK
+	for i, file := range placed {
+		err := unplacePendingFile(h, file)
+		if err != nil {
+			log.Printf("Failed to roll back verified file %d: %v", file.PendingFile.FileId, err)
+			results[i]["rolledBack"] = false
+			results[i]["error"] = "Failed to roll back"
+			status = fiber.StatusInternalServerError
+			continue
+		}
+		results[i] = verifyFilesError(fileIds[i], "Another file in the batch failed")
+		results[i]["rolledBack"] = true
+	}
+
+	return c.Status(status).JSON(results)
+}
+
+func verifyFilesError(fileId int64, message string) fiber.Map {
+	return fiber.Map{
+		"fileId": strconv.FormatInt(fileId, 10),
+		"error":  message,
+	}
+}
+
+// errorMessage returns what the ErrorHandler would have sent as the message of err.
+func errorMessage(err error) string {
+	var e *fiber.Error
+	if errors.As(err, &e) {
+		return e.Message
+	}
+	return err.Error()
+}
@@ -9,8 +9,10 @@ import (
 	"errors"
 	"path/filepath"
 	"runtime"
+	"strconv"
+	"strings"
+	"time"
 
-	"github.com/cshum/vipsgen/vips"
 	"github.com/gofiber/fiber/v3"
 )
 
@@ -20,23 +22,33 @@ func main() {
 	_, filename, _, _ := runtime.Caller(0)
 	env.ProjectRoot = filepath.Dir(filename)
 
-	pendingFilesManager := utils.NewPendingFilesManager()
-	pendingFilesManager.StartCleanup()
-	utils.FlushTempFilesWithRoot(env.ProjectRoot)
+	database := database.NewDatabaseService(env.DatabaseUrl)
+	pendingStore := utils.NewPendingStore(env.PendingStore, database)
+	pendingStore.StartCleanup()
+	tusUploadsManager := utils.NewTusUploadsManager()
+	tusUploadsManager.StartCleanup()
+	uploadSessionsManager := utils.NewUploadSessionsManager()
+	uploadSessionsManager.StartCleanup()
+	utils.FlushTempFilesWithRoot(env.ProjectRoot, pendingStore.Durable())
 	utils.StartVideoThumbnailCleanup(env.ProjectRoot)
+	utils.StartQuarantineCleanup(env.ProjectRoot, env.QuarantineMaxAge)
 
 	// utils.StartFileCleanup()
 
 	flake := utils.NewFlake()
 	jwt := security.NewJWTService(env.JwtSecret)
-	database := database.NewDatabaseService(env.DatabaseUrl)
-	utils.StartDeleteExpiredFiles(database)
+	utils.StartDeleteExpiredFiles(env.ProjectRoot, database)
 
-	vips.Startup(nil)
-	defer vips.Shutdown()
+	utils.StartupVips()
+	defer utils.ShutdownVips()
 
 	app := fiber.New(fiber.Config{
 		StreamRequestBody: true,
+		ReadTimeout:       env.ReadTimeout,
+		WriteTimeout:      env.WriteTimeout,
+		IdleTimeout:       env.IdleTimeout,
+		// Multipart bodies are streamed by the upload handler, fasthttp would otherwise buffer them first.
+		DisablePreParseMultipartForm: true,
 		ErrorHandler: func(c fiber.Ctx, err error) error {
 			code := fiber.StatusInternalServerError
 
@@ -68,10 +80,17 @@ func main() {
 		}
 
 		if c.Method() == fiber.MethodOptions {
-			c.Set("Access-Control-Allow-Headers", "Content-Type, Authorization, File-Name")
-			c.Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, PATCH, OPTIONS")
+			c.Set("Access-Control-Allow-Headers", "Content-Type, Authorization, File-Name, Upload-Id, Repr-Digest, Digest, Content-MD5, Tus-Resumable, Upload-Length, Upload-Offset, Upload-Metadata")
+			c.Set("Access-Control-Allow-Methods", "GET, HEAD, POST, PUT, DELETE, PATCH, OPTIONS")
+			if strings.Contains(c.Path(), "/tus") {
+				c.Set("Tus-Resumable", handlers.TusVersion)
+				c.Set("Tus-Version", handlers.TusVersion)
+				c.Set("Tus-Extension", handlers.TusExtensions)
+				c.Set("Tus-Max-Size", strconv.FormatInt(env.UploadPolicy("attachments").MaxBytes, 10))
+			}
 			return c.SendStatus(fiber.StatusNoContent)
 		}
+		c.Set("Access-Control-Expose-Headers", "Location, Tus-Resumable, Tus-Version, Upload-Offset, Upload-Length, File-Id, Retry-After")
 
 		return c.Next()
 	})
@@ -80,11 +99,25 @@ func main() {
 		return c.SendString("Nerimity CDN Online.")
 	})
 
-	contentHandler := handlers.NewContentHandler(&handlers.ContentHandler{Env: env})
-	uploadHandler := handlers.NewUploadHandler(&handlers.UploadHandler{Env: env, Flake: flake, Jwt: jwt, PendingFilesManager: pendingFilesManager})
-	internalHandler := handlers.NewInternalHandler(&handlers.InternalHandler{Env: env, Jwt: jwt, PendingFileManager: pendingFilesManager, Database: database})
+	imageProcessor := utils.NewImageProcessor(env.ImageProcessor, utils.ImageLimits{MaxPixels: env.ProxyMaxPixels, MaxFrames: env.ProxyMaxFrames})
+	rateLimiter := utils.NewRateLimiter()
+	rateLimiter.StartCleanup(time.Hour)
+	scanner, err := utils.NewScanner(env.ScannerAddress)
+	if err != nil {
+		panic(err)
+	}
+
+	contentHandler := handlers.NewContentHandler(&handlers.ContentHandler{Env: env, ImageProcessor: imageProcessor})
+	uploadHandler := handlers.NewUploadHandler(&handlers.UploadHandler{Env: env, Flake: flake, Jwt: jwt, PendingStore: pendingStore, TusUploadsManager: tusUploadsManager, ImageProcessor: imageProcessor, Scanner: scanner, RateLimiter: rateLimiter, UploadSessions: uploadSessionsManager, Database: database})
+	internalHandler := handlers.NewInternalHandler(&handlers.InternalHandler{Env: env, Jwt: jwt, Flake: flake, PendingStore: pendingStore, Database: database, UploadHandler: uploadHandler})
 	proxyHandler := handlers.NewProxyHandler(&handlers.ProxyHandler{Env: env})
 
+	// Resumable (tus) uploads, registered before the GET wildcards so HEAD requests reach them.
+	app.Post("/attachments/:groupId/tus", uploadHandler.TusCreate)
+	app.Head("/attachments/:groupId/tus/:uploadId", uploadHandler.TusHead)
+	app.Patch("/attachments/:groupId/tus/:uploadId", uploadHandler.TusPatch)
+	app.Delete("/attachments/:groupId/tus/:uploadId", uploadHandler.TusDelete)
+
 	// Video thumbnails
 	app.Get("/attachments/*/thumb.webp", contentHandler.GetContentThumb)
 
@@ -98,16 +131,29 @@ func main() {
 	app.Post("/avatars/:groupId", uploadHandler.UploadFile)
 	app.Post("/profile_banners/:groupId", uploadHandler.UploadFile)
 	app.Post("/emojis", uploadHandler.UploadFile)
+	app.Post("/uploads/init", uploadHandler.InitUpload)
+	app.Post("/uploads/:fileId/extend", uploadHandler.ExtendUpload)
+	app.Delete("/uploads/:fileId", uploadHandler.CancelUpload)
 
 	app.Get("/proxy-dimensions", proxyHandler.GetImageDimensions)
 	app.Get("/proxy/:imageUrl/:filename", proxyHandler.GetProxy)
 
 	app.Post("/internal/generate-token", internalHandler.GenerateToken)
 	app.Post("/internal/verify-file", internalHandler.VerifyFile)
+	app.Post("/internal/verify-files", internalHandler.VerifyFiles)
+	app.Post("/internal/extend-file", internalHandler.ExtendFile)
+	app.Get("/internal/pending-files", internalHandler.ListPendingFiles)
+	app.Post("/internal/ingest", internalHandler.Ingest)
+	app.Post("/internal/credentials", internalHandler.CreateCredential)
+	app.Get("/internal/credentials", internalHandler.ListCredentials)
+	app.Delete("/internal/credentials/:credentialId", internalHandler.RevokeCredential)
 	app.Delete("/internal/batch", internalHandler.DeleteByFileIds)
 	app.Delete("/internal/attachments/:groupId/batch", internalHandler.DeleteAttachmentsByGroupId)
 	app.Delete("/internal/", internalHandler.DeleteFile)
 
+	// Lets uploads sent with "Expect: 100-continue" be rejected before their body is sent.
+	app.Server().HeaderReceived = uploadHandler.HeaderReceived
+
 	app.Listen(":" + env.Port)
 
 }
@@ -0,0 +1,19 @@
+CREATE TABLE "UploadCredential" (
+    "id" TEXT NOT NULL,
+    "tokenHash" TEXT NOT NULL,
+    "userId" TEXT NOT NULL,
+    "name" TEXT NOT NULL DEFAULT '',
+    "categories" TEXT[] NOT NULL,
+    "groupIds" TEXT[] NOT NULL DEFAULT '{}',
+    "rateLimitRequests" INTEGER NOT NULL DEFAULT 0,
+    "rateLimitBytes" BIGINT NOT NULL DEFAULT 0,
+    "rateLimitWindowSeconds" INTEGER NOT NULL DEFAULT 0,
+    "rateLimitConcurrent" INTEGER NOT NULL DEFAULT 0,
+    "createdAt" TIMESTAMP(3) NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    "revokedAt" TIMESTAMP(3),
+
+    CONSTRAINT "UploadCredential_pkey" PRIMARY KEY ("id")
+);
+
+CREATE UNIQUE INDEX "UploadCredential_tokenHash_key" ON "UploadCredential"("tokenHash");
+CREATE INDEX "UploadCredential_userId_idx" ON "UploadCredential"("userId");
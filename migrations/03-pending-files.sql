@@ -0,0 +1,15 @@
+CREATE TABLE "PendingFile" (
+    "fileId" TEXT NOT NULL,
+    "userId" TEXT NOT NULL,
+    "groupId" TEXT NOT NULL,
+    "category" TEXT NOT NULL,
+    "path" TEXT NOT NULL,
+    "data" JSONB NOT NULL,
+    "expiresAt" TIMESTAMPTZ(3) NOT NULL,
+    "createdAt" TIMESTAMPTZ(3) NOT NULL DEFAULT CURRENT_TIMESTAMP,
+
+    CONSTRAINT "PendingFile_pkey" PRIMARY KEY ("fileId")
+);
+
+CREATE INDEX "PendingFile_expiresAt_idx" ON "PendingFile"("expiresAt");
+CREATE INDEX "PendingFile_path_idx" ON "PendingFile"("path");
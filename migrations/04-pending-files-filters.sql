@@ -0,0 +1,2 @@
+CREATE INDEX "PendingFile_userId_idx" ON "PendingFile"("userId");
+CREATE INDEX "PendingFile_groupId_idx" ON "PendingFile"("groupId");
@@ -0,0 +1,56 @@
+package security
+
+import (
+	"cdn_nerimity_go/config"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"slices"
+	"strings"
+	"time"
+)
+
+// CredentialPrefix starts every upload credential token, so they can't be mistaken for a JWT.
+const CredentialPrefix = "ncdn_"
+
+// UploadCredential is a long lived token for bots and webhooks. Unlike user tokens it is stored in the
+// database so it can be revoked, and it can only upload to the categories and groups it lists.
+type UploadCredential struct {
+	Id         string
+	UserId     string
+	Name       string
+	Categories []string
+	GroupIds   []string               // empty allows every group
+	RateLimit  config.UploadRateLimit // all zero uses the limits of the category
+	CreatedAt  time.Time
+}
+
+// GenerateCredentialToken returns a new token and the hash it is stored under, the token itself is never stored.
+func GenerateCredentialToken() (token string, hash string, err error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", "", err
+	}
+	token = CredentialPrefix + hex.EncodeToString(secret)
+	return token, HashCredentialToken(token), nil
+}
+
+func HashCredentialToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func IsCredentialToken(token string) bool {
+	return strings.HasPrefix(token, CredentialPrefix)
+}
+
+// Allows reports if the credential may upload to the category and group, groupId is empty for categories without groups.
+func (c *UploadCredential) Allows(category string, groupId string) bool {
+	if !slices.Contains(c.Categories, category) {
+		return false
+	}
+	if groupId != "" && len(c.GroupIds) > 0 && !slices.Contains(c.GroupIds, groupId) {
+		return false
+	}
+	return true
+}
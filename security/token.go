@@ -20,6 +20,8 @@ func NewJWTService(secret string) *JWTService {
 type Claims struct {
 	jwt.RegisteredClaims
 	UserId string `json:"user_id"`
+	// Credential is set when the request was made with an upload credential instead of a user token.
+	Credential *UploadCredential `json:"-"`
 }
 
 func (s *JWTService) GenerateToken(id int64) (string, error) {
@@ -0,0 +1,167 @@
+package utils
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+)
+
+// Identical files are stored once under blobs/<first two hash chars>/<sha256>.
+// Every public/ path is a hardlink to its blob, so the link count of the blob is its reference count:
+// a blob with a link count of 1 is only referenced by the blob store itself and can be removed.
+
+const BlobsDir = "blobs"
+
+// The hash of a blob is also kept in an extended attribute of its inode, which every hardlink shares,
+// so the blob behind a public path can be found without reading the whole file.
+const blobHashXattr = "user.nerimity.sha256"
+
+var blobMu sync.Mutex
+
+func BlobPath(root string, hash string) string {
+	return filepath.Join(root, BlobsDir, hash[:2], hash)
+}
+
+func HashFile(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	buf := make([]byte, 1024*1024)
+	if _, err := io.CopyBuffer(hash, file, buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// PlaceFile moves srcPath to dstPath, sharing the blob with any earlier file with the same hash.
+// If the blob store can't be used (e.g. it lives on another filesystem) the file is moved as is.
+// dstPath must be inside root/public, which is where a copy is prepared when files can't be moved.
+func PlaceFile(root string, hash string, srcPath string, dstPath string) error {
+	blobMu.Lock()
+	defer blobMu.Unlock()
+
+	publicRoot := filepath.Join(root, "public")
+	blobPath := BlobPath(root, hash)
+	err := os.MkdirAll(filepath.Dir(blobPath), 0755)
+	if err != nil {
+		return MoveFile(srcPath, dstPath, publicRoot)
+	}
+
+	if _, err := os.Stat(blobPath); err == nil {
+		// srcPath is only removed once dstPath holds the content. Another instance sharing root can
+		// remove the blob at any time, blobMu only keeps this one from doing so.
+		if err := os.Link(blobPath, dstPath); err == nil {
+			os.Remove(srcPath)
+			return SyncDir(filepath.Dir(dstPath))
+		}
+		// The blob is gone, or public/ can't hardlink into the blob store.
+		return MoveFile(srcPath, dstPath, publicRoot)
+	}
+
+	err = MoveFile(srcPath, blobPath, filepath.Join(root, BlobsDir))
+	if err != nil {
+		return MoveFile(srcPath, dstPath, publicRoot)
+	}
+	syscall.Setxattr(blobPath, blobHashXattr, []byte(hash), 0)
+
+	err = os.Link(blobPath, dstPath)
+	if err == nil {
+		return SyncDir(filepath.Dir(dstPath))
+	}
+
+	// public/ can't hardlink into the blob store, so give it a private copy instead.
+	if err := MoveFile(blobPath, dstPath, publicRoot); err == nil {
+		return nil
+	}
+	err = copyFile(blobPath, dstPath, publicRoot)
+	if err != nil {
+		// Nothing else links to the new blob, it is the only copy of the upload.
+		MoveFile(blobPath, srcPath, filepath.Dir(srcPath))
+		return err
+	}
+	os.Remove(blobPath)
+	return nil
+}
+
+// UnplaceFile undoes PlaceFile, moving dstPath back to srcPath and removing the blob if nothing else uses it.
+func UnplaceFile(root string, dstPath string, srcPath string) error {
+	return removeWithBlob(root, dstPath, func() error {
+		return MoveFile(dstPath, srcPath, filepath.Dir(srcPath))
+	})
+}
+
+// removeWithBlob runs remove, which takes path out of public/, and removes the blob behind path if path was
+// its last public reference. The link count is checked and both are removed under blobMu, otherwise two
+// removals of the same content could each see the other's link and leave the blob behind.
+func removeWithBlob(root string, path string, remove func() error) error {
+	blobMu.Lock()
+	defer blobMu.Unlock()
+
+	blobPath := lastBlobReference(root, path)
+	err := remove()
+	if err != nil {
+		return err
+	}
+
+	if blobPath != "" {
+		os.Remove(blobPath)
+		os.Remove(filepath.Dir(blobPath))
+	}
+	return nil
+}
+
+// lastBlobReference returns the blob behind path when path is its only public link, or "".
+func lastBlobReference(root string, path string) string {
+	info, err := os.Stat(path)
+	if err != nil || info.IsDir() {
+		return ""
+	}
+
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok || stat.Nlink != 2 {
+		return ""
+	}
+
+	hash, err := blobHash(path)
+	if err != nil {
+		return ""
+	}
+
+	blobPath := BlobPath(root, hash)
+	blobInfo, err := os.Stat(blobPath)
+	if err != nil || !os.SameFile(info, blobInfo) {
+		return ""
+	}
+	return blobPath
+}
+
+// blobHash reads the hash PlaceFile recorded on the inode, files placed before it did that are hashed instead.
+func blobHash(path string) (string, error) {
+	buf := make([]byte, sha256.Size*2)
+	n, err := syscall.Getxattr(path, blobHashXattr, buf)
+	if err == nil && n == len(buf) {
+		return string(buf), nil
+	}
+	return HashFile(path)
+}
+
+// RemoveAllWithBlobs is os.RemoveAll that also releases the blobs of every file inside dir.
+func RemoveAllWithBlobs(root string, dir string) error {
+	filepath.WalkDir(dir, func(path string, entry os.DirEntry, err error) error {
+		if err == nil && !entry.IsDir() {
+			removeWithBlob(root, path, func() error {
+				return os.Remove(path)
+			})
+		}
+		return nil
+	})
+	return os.RemoveAll(dir)
+}
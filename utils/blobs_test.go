@@ -0,0 +1,121 @@
+package utils
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func writeUpload(t *testing.T, root string, name string, content string) (string, string) {
+	t.Helper()
+
+	path := filepath.Join(root, "temp", name)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	hash, err := HashFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path, hash
+}
+
+func placeTestFile(t *testing.T, root string, hash string, srcPath string, name string) string {
+	t.Helper()
+
+	dstPath := filepath.Join(root, "public", "attachments", name)
+	if err := os.MkdirAll(filepath.Dir(dstPath), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := PlaceFile(root, hash, srcPath, dstPath); err != nil {
+		t.Fatalf("PlaceFile: %v", err)
+	}
+	return dstPath
+}
+
+func linkCount(t *testing.T, path string) uint64 {
+	t.Helper()
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return uint64(info.Sys().(*syscall.Stat_t).Nlink)
+}
+
+func TestPlaceFileSharesBlob(t *testing.T) {
+	root := t.TempDir()
+	first, hash := writeUpload(t, root, "1.txt", "same content")
+	second, _ := writeUpload(t, root, "2.txt", "same content")
+
+	firstDst := placeTestFile(t, root, hash, first, "1.txt")
+	secondDst := placeTestFile(t, root, hash, second, "2.txt")
+
+	for _, path := range []string{first, second} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("upload %s was not removed: %v", path, err)
+		}
+	}
+	for _, path := range []string{firstDst, secondDst} {
+		if data, err := os.ReadFile(path); err != nil || string(data) != "same content" {
+			t.Errorf("%s = %q, %v", path, data, err)
+		}
+	}
+
+	blobPath := BlobPath(root, hash)
+	if got := linkCount(t, blobPath); got != 3 {
+		t.Errorf("blob has %d links, want 3", got)
+	}
+
+	if err := DeleteRecursiveEmpty(root, firstDst); err != nil {
+		t.Fatal(err)
+	}
+	if got := linkCount(t, blobPath); got != 2 {
+		t.Errorf("blob has %d links after one delete, want 2", got)
+	}
+	if err := DeleteRecursiveEmpty(root, secondDst); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(blobPath); !os.IsNotExist(err) {
+		t.Errorf("blob was kept after its last reference was deleted: %v", err)
+	}
+}
+
+// An existing blob that can't be linked to must not cost the upload.
+func TestPlaceFileKeepsUploadWhenLinkFails(t *testing.T) {
+	root := t.TempDir()
+	src, hash := writeUpload(t, root, "1.txt", "content")
+
+	// A directory can be found with Stat but not hardlinked, like a blob another instance just removed.
+	if err := os.MkdirAll(BlobPath(root, hash), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	dst := placeTestFile(t, root, hash, src, "1.txt")
+	if data, err := os.ReadFile(dst); err != nil || string(data) != "content" {
+		t.Errorf("placed file = %q, %v", data, err)
+	}
+}
+
+func TestUnplaceFile(t *testing.T) {
+	root := t.TempDir()
+	src, hash := writeUpload(t, root, "1.txt", "content")
+	dst := placeTestFile(t, root, hash, src, "1.txt")
+
+	if err := UnplaceFile(root, dst, src); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := os.ReadFile(src); err != nil || string(data) != "content" {
+		t.Errorf("unplaced file = %q, %v", data, err)
+	}
+	if _, err := os.Stat(dst); !os.IsNotExist(err) {
+		t.Errorf("placed file was kept: %v", err)
+	}
+	if _, err := os.Stat(BlobPath(root, hash)); !os.IsNotExist(err) {
+		t.Errorf("blob was kept: %v", err)
+	}
+}
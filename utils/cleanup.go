@@ -57,11 +57,21 @@ func cleanupOldFiles(dir string, ageThreshold time.Duration) {
 // }
 
 func FlushTempFiles() {
-	FlushTempFilesWithRoot(".")
+	FlushTempFilesWithRoot(".", false)
 }
 
-func FlushTempFilesWithRoot(root string) {
-	flushDir(filepath.Join(root, "temp"))
+// FlushTempFilesWithRoot runs at startup. Interrupted writes are quarantined first, the files left in temp/
+// after that are complete but their pending uploads did not survive the restart.
+// With a durable PendingStore they did, so temp/ is kept. It may also be shared with other instances,
+// only partial files too old to still be written to are quarantined then.
+func FlushTempFilesWithRoot(root string, durablePending bool) {
+	if durablePending {
+		RecoverPartialFiles(root, pendingOrphanAge, "temp", "public", BlobsDir)
+		os.MkdirAll(filepath.Join(root, "temp"), 0755)
+	} else {
+		RecoverPartialFiles(root, 0, "temp", "public", BlobsDir)
+		flushDir(filepath.Join(root, "temp"))
+	}
 	flushDir(filepath.Join(root, "video-thumb-cache"))
 }
 
@@ -77,7 +87,7 @@ func flushDir(dir string) {
 	}
 }
 
-func deleteExpiredFiles(databaseService *database.DatabaseService) {
+func deleteExpiredFiles(root string, databaseService *database.DatabaseService) {
 	expiredFiles, err := databaseService.GetExpiredFiles()
 	if err != nil {
 		log.Printf("Error getting expired files: %v", err)
@@ -89,7 +99,7 @@ func deleteExpiredFiles(databaseService *database.DatabaseService) {
 	for i, file := range expiredFiles {
 		fileIds[i] = file.FileID
 
-		path := "public/attachments/" + strconv.FormatInt(file.GroupID, 10) + "/" + strconv.FormatInt(file.FileID, 10)
+		path := filepath.Join(root, "public/attachments", strconv.FormatInt(file.GroupID, 10), strconv.FormatInt(file.FileID, 10))
 		if err != nil {
 			_, err := os.Stat(path)
 			if os.IsNotExist(err) {
@@ -98,7 +108,7 @@ func deleteExpiredFiles(databaseService *database.DatabaseService) {
 			log.Printf("Error removing expired file %s: %v", path, err)
 			return
 		}
-		err := os.RemoveAll(path)
+		err := RemoveAllWithBlobs(root, path)
 		if err != nil {
 			log.Printf("Error removing expired file %s: %v", path, err)
 			return
@@ -112,7 +122,7 @@ func deleteExpiredFiles(databaseService *database.DatabaseService) {
 	}
 }
 
-func StartDeleteExpiredFiles(databaseService *database.DatabaseService) {
+func StartDeleteExpiredFiles(root string, databaseService *database.DatabaseService) {
 	interval := 1 * time.Minute
 
 	go func() {
@@ -120,7 +130,7 @@ func StartDeleteExpiredFiles(databaseService *database.DatabaseService) {
 		defer ticker.Stop()
 
 		for range ticker.C {
-			deleteExpiredFiles(databaseService)
+			deleteExpiredFiles(root, databaseService)
 		}
 	}()
 }
@@ -140,14 +150,33 @@ func StartVideoThumbnailCleanup(root string) {
 	}()
 }
 
-func DeleteRecursiveEmpty(filePath string) error {
-	const stopAt = "public"
+// StartQuarantineCleanup removes interrupted writes once they have been quarantined for maxAge.
+// A zero maxAge keeps them until they are removed by hand.
+func StartQuarantineCleanup(root string, maxAge time.Duration) {
+	if maxAge <= 0 {
+		return
+	}
+	interval := 1 * time.Hour
+
+	go func() {
+		pruneQuarantine(root, maxAge)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			pruneQuarantine(root, maxAge)
+		}
+	}()
+}
 
-	filePath = filepath.Clean(filePath)
-	absStopAt, _ := filepath.Abs(stopAt)
-	absFilePath, _ := filepath.Abs(filePath)
+func DeleteRecursiveEmpty(root string, filePath string) error {
+	absStopAt, _ := filepath.Abs(filepath.Join(root, "public"))
+	absFilePath, _ := filepath.Abs(filepath.Clean(filePath))
 
-	err := DeleteWithRetry(absFilePath, 5)
+	err := removeWithBlob(root, absFilePath, func() error {
+		return DeleteWithRetry(absFilePath, 5)
+	})
 	if err != nil {
 		return err
 	}
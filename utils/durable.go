@@ -0,0 +1,166 @@
+package utils
+
+import (
+	"errors"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// Files are written inside a PartialDir and only renamed to their real name once they are complete and synced.
+// A file's real name therefore never points at half written data, and whatever is still inside a PartialDir
+// after a crash was interrupted.
+const PartialDir = ".partial"
+
+// QuarantineDir is where interrupted writes are moved at startup, so they can be looked at instead of being lost.
+// StartQuarantineCleanup removes them again after a while.
+const QuarantineDir = "quarantine"
+
+// CreatePartial creates an empty file in the PartialDir of dir. The PartialDir must be on the same
+// filesystem as the file's final location, so the final rename is atomic.
+func CreatePartial(dir string) (*os.File, error) {
+	partialDir := filepath.Join(dir, PartialDir)
+	if err := os.MkdirAll(partialDir, 0755); err != nil {
+		return nil, err
+	}
+	return os.CreateTemp(partialDir, "*")
+}
+
+// CommitFile syncs a fully written file and renames it to dstPath.
+func CommitFile(srcPath string, dstPath string) error {
+	if err := SyncFile(srcPath); err != nil {
+		return err
+	}
+	os.Chmod(srcPath, 0644)
+	if err := os.Rename(srcPath, dstPath); err != nil {
+		return err
+	}
+	return SyncDir(filepath.Dir(dstPath))
+}
+
+// MoveFile renames srcPath to dstPath. Across filesystems, where a rename is not possible, the file is copied
+// into the PartialDir of partialRoot and swapped in with a rename, so dstPath is never seen half written.
+// partialRoot must be on the same filesystem as dstPath.
+func MoveFile(srcPath string, dstPath string, partialRoot string) error {
+	err := os.Rename(srcPath, dstPath)
+	if errors.Is(err, syscall.EXDEV) {
+		err = copyFile(srcPath, dstPath, partialRoot)
+		if err == nil {
+			os.Remove(srcPath)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	return SyncDir(filepath.Dir(dstPath))
+}
+
+func copyFile(srcPath string, dstPath string, partialRoot string) error {
+	src, err := os.Open(srcPath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := CreatePartial(partialRoot)
+	if err != nil {
+		return err
+	}
+	partialPath := dst.Name()
+
+	buf := make([]byte, 1024*1024)
+	_, err = io.CopyBuffer(dst, src, buf)
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = CommitFile(partialPath, dstPath)
+	}
+	if err != nil {
+		os.Remove(partialPath)
+	}
+	return err
+}
+
+func SyncFile(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return file.Sync()
+}
+
+// SyncDir makes renames and new links inside dir durable.
+func SyncDir(dir string) error {
+	return SyncFile(dir)
+}
+
+// RecoverPartialFiles runs at startup. Interrupted writes are moved out of every PartialDir under root
+// into QuarantineDir/<unix time>/, keeping their path relative to root.
+// Files modified less than minAge ago are left alone, another instance sharing root may still be writing them.
+func RecoverPartialFiles(root string, minAge time.Duration, dirs ...string) {
+	quarantine := filepath.Join(root, QuarantineDir, strconv.FormatInt(time.Now().Unix(), 10))
+
+	for _, dir := range dirs {
+		partialDir := filepath.Join(root, dir, PartialDir)
+		entries, err := os.ReadDir(partialDir)
+		if err != nil {
+			continue
+		}
+
+		for _, entry := range entries {
+			if minAge > 0 {
+				info, err := entry.Info()
+				if err != nil || time.Since(info.ModTime()) < minAge {
+					continue
+				}
+			}
+
+			src := filepath.Join(partialDir, entry.Name())
+			dst := filepath.Join(quarantine, dir, entry.Name())
+			if err := os.MkdirAll(filepath.Dir(dst), 0755); err == nil {
+				err = MoveFile(src, dst, filepath.Join(quarantine, dir))
+			}
+			if err != nil {
+				log.Printf("Failed to quarantine interrupted write %s: %v", src, err)
+				continue
+			}
+			log.Printf("Quarantined interrupted write %s to %s", src, dst)
+		}
+	}
+}
+
+// pruneQuarantine removes the QuarantineDir/<unix time>/ directories older than maxAge.
+func pruneQuarantine(root string, maxAge time.Duration) {
+	quarantine := filepath.Join(root, QuarantineDir)
+	entries, err := os.ReadDir(quarantine)
+	if err != nil {
+		return
+	}
+
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		unix, err := strconv.ParseInt(entry.Name(), 10, 64)
+		if err != nil {
+			// Not made by RecoverPartialFiles, so it is left to whoever put it there.
+			continue
+		}
+		if time.Since(time.Unix(unix, 0)) < maxAge {
+			continue
+		}
+
+		path := filepath.Join(quarantine, entry.Name())
+		if err := os.RemoveAll(path); err != nil {
+			log.Printf("Failed to remove quarantined writes %s: %v", path, err)
+			continue
+		}
+		log.Printf("Removed quarantined writes %s", path)
+	}
+}
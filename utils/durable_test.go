@@ -0,0 +1,73 @@
+package utils
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestRecoverPartialFiles(t *testing.T) {
+	root := t.TempDir()
+	partialDir := filepath.Join(root, "temp", PartialDir)
+	if err := os.MkdirAll(partialDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	old := filepath.Join(partialDir, "old")
+	recent := filepath.Join(partialDir, "recent")
+	for _, path := range []string{old, recent} {
+		if err := os.WriteFile(path, []byte("partial"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	past := time.Now().Add(-2 * time.Hour)
+	if err := os.Chtimes(old, past, past); err != nil {
+		t.Fatal(err)
+	}
+
+	RecoverPartialFiles(root, time.Hour, "temp")
+
+	if _, err := os.Stat(old); !os.IsNotExist(err) {
+		t.Errorf("old partial file was not quarantined: %v", err)
+	}
+	if _, err := os.Stat(recent); err != nil {
+		t.Errorf("recent partial file was quarantined: %v", err)
+	}
+	quarantined, _ := filepath.Glob(filepath.Join(root, QuarantineDir, "*", "temp", "old"))
+	if len(quarantined) != 1 {
+		t.Errorf("found %d quarantined copies of the old file, want 1", len(quarantined))
+	}
+}
+
+func TestPruneQuarantine(t *testing.T) {
+	root := t.TempDir()
+	quarantine := filepath.Join(root, QuarantineDir)
+	now := time.Now()
+	dirs := map[string]bool{
+		strconv.FormatInt(now.Add(-8*24*time.Hour).Unix(), 10): false,
+		strconv.FormatInt(now.Add(-6*24*time.Hour).Unix(), 10): true,
+		strconv.FormatInt(now.Unix(), 10):                      true,
+		"notes":                                                true,
+	}
+	for dir := range dirs {
+		if err := os.MkdirAll(filepath.Join(quarantine, dir, "temp"), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(quarantine, dir, "temp", "file"), []byte("partial"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	pruneQuarantine(root, 7*24*time.Hour)
+
+	for dir, kept := range dirs {
+		_, err := os.Stat(filepath.Join(quarantine, dir))
+		if kept && err != nil {
+			t.Errorf("%s was removed: %v", dir, err)
+		}
+		if !kept && !os.IsNotExist(err) {
+			t.Errorf("%s was kept", dir)
+		}
+	}
+}
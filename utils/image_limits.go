@@ -0,0 +1,38 @@
+package utils
+
+import (
+	"errors"
+)
+
+var (
+	ErrImageTooManyPixels = errors.New("Image dimensions are too large")
+	ErrImageTooManyFrames = errors.New("Image has too many frames")
+)
+
+// ImageLimits guards against images that are small on disk but huge once decoded, zero disables a limit.
+type ImageLimits struct {
+	MaxPixels int64 // width*height of a single frame
+	MaxFrames int
+}
+
+// ImageHeader holds the dimensions as displayed, with the EXIF orientation applied.
+type ImageHeader struct {
+	Width  int
+	Height int // height of a single frame
+	Frames int
+}
+
+// isRotatedOrientation reports whether an EXIF orientation turns the image by 90 or 270 degrees.
+func isRotatedOrientation(orientation int) bool {
+	return orientation >= 5 && orientation <= 8
+}
+
+func (l ImageLimits) Check(header *ImageHeader) error {
+	if l.MaxPixels > 0 && int64(header.Width)*int64(header.Height) > l.MaxPixels {
+		return ErrImageTooManyPixels
+	}
+	if l.MaxFrames > 0 && header.Frames > l.MaxFrames {
+		return ErrImageTooManyFrames
+	}
+	return nil
+}
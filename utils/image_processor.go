@@ -0,0 +1,70 @@
+package utils
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/gofiber/fiber/v3"
+	"github.com/gofiber/fiber/v3/middleware/proxy"
+)
+
+// ImageProcessor resizes, crops and converts images to WebP.
+type ImageProcessor interface {
+	// Compress writes a WebP version of the local image at opts.Path to outputPath.
+	Compress(opts ImageProxyOptions, outputPath string) error
+	// ServeLocal responds with a WebP version of a local image, fitted inside opts.Size when set.
+	ServeLocal(c fiber.Ctx, opts BasicImageProxyOptions) error
+}
+
+// limits guards ServeLocal, which loads files that are already stored. The imgproxy daemon has its own limits.
+func NewImageProcessor(name string, limits ImageLimits) ImageProcessor {
+	if name == "vips" {
+		return &VipsImageProcessor{Limits: limits}
+	}
+	return &ImgproxyImageProcessor{}
+}
+
+// ImgproxyImageProcessor sends the work to the imgproxy daemon listening on BASE_PROXY.
+type ImgproxyImageProcessor struct{}
+
+func (p *ImgproxyImageProcessor) Compress(opts ImageProxyOptions, outputPath string) error {
+	url, err := GenerateImageProxyURL(opts)
+	if err != nil {
+		return err
+	}
+
+	client := &http.Client{
+		Timeout: 30 * time.Second,
+	}
+
+	resp, err := client.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to fetch: %s", resp.Status)
+	}
+
+	file, err := os.Create(outputPath)
+	if err != nil {
+		return err
+	}
+
+	buffer := make([]byte, 1024*1024)
+	_, err = io.CopyBuffer(file, resp.Body, buffer)
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	return file.Close()
+}
+
+func (p *ImgproxyImageProcessor) ServeLocal(c fiber.Ctx, opts BasicImageProxyOptions) error {
+	return proxy.Do(c, GenerateBasicImageProxyURL(opts))
+}
@@ -6,8 +6,6 @@ import (
 	"fmt"
 	"math"
 	"strings"
-
-	"github.com/cshum/vipsgen/vips"
 )
 
 const BASE_PROXY = "http://localhost:8888/pr:sharp/"
@@ -28,6 +26,9 @@ func GenerateBasicImageProxyURL(opts BasicImageProxyOptions) string {
 	}
 	var encodedPath = EncodeURIComponent(path)
 
+	// Rotate by the EXIF orientation and convert to sRGB, whatever the imgproxy defaults are.
+	parts = append(parts, "ar:1", "scp:1")
+
 	if opts.Static {
 		var static = "page:0"
 		parts = append(parts, static)
@@ -77,15 +78,13 @@ func GenerateImageProxyURL(opts ImageProxyOptions) (string, error) {
 
 	var encodedPath = EncodeURIComponent(path)
 
-	image, err := vips.NewImageFromFile(opts.Path, nil)
+	// imgproxy applies the orientation before cropping and resizing, so both work on the upright dimensions.
+	header, err := ProbeImage(opts.Path)
 	if err != nil {
 		return "", err
 	}
-	defer image.Close()
-
-	// isAnimated := image.Pages()
-	width := image.Width()
-	height := image.Height()
+	width := header.Width
+	height := header.Height
 
 	aspectRatio := float64(opts.Size.Width) / float64(opts.Size.Height)
 
@@ -97,6 +96,12 @@ func GenerateImageProxyURL(opts ImageProxyOptions) (string, error) {
 		},
 	)
 
+	parts = append(parts, "ar:1", "scp:1")
+
+	if opts.Static {
+		parts = append(parts, "page:0")
+	}
+
 	if opts.Size.ResizeType == ResizeTypeFit {
 		parts = append(parts, "rs:fit:"+fmt.Sprintf("%d:%d", opts.Size.Width, opts.Size.Height))
 	}
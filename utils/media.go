@@ -13,7 +13,8 @@ func IsAudioOrVideo(ext string) bool {
 
 func IsMimeAudioOrVideo(mime string) bool {
 	switch mime {
-	case "video/mp4", "video/webm", "video/ogg", "video/mp3", "video/wav":
+	case "video/mp4", "video/webm", "video/ogg", "video/mp3", "video/wav",
+		"audio/mpeg", "audio/ogg", "audio/wav", "audio/webm":
 		return true
 	default:
 		return false
@@ -22,7 +23,8 @@ func IsMimeAudioOrVideo(mime string) bool {
 
 func IsMimeImage(mime string) bool {
 	switch mime {
-	case "image/webp", "image/png", "image/jpeg", "image/jpg", "image/gif":
+	case "image/webp", "image/png", "image/jpeg", "image/jpg", "image/gif",
+		"image/heic", "image/heif", "image/avif", "image/jxl":
 		return true
 	default:
 		return false
@@ -40,7 +42,7 @@ func IsVideo(ext string) bool {
 
 func IsImage(ext string) bool {
 	switch strings.ToLower(ext) {
-	case ".webp", ".png", ".jpg", ".jpeg", ".gif":
+	case ".webp", ".png", ".jpg", ".jpeg", ".gif", ".heic", ".heif", ".avif", ".jxl":
 		return true
 	default:
 		return false
@@ -0,0 +1,364 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Lossless metadata stripping for images that are stored without being re-encoded.
+// Only the container is rewritten, the compressed image data is copied byte for byte.
+
+type MetadataKeep struct {
+	Orientation bool
+	ICC         bool
+}
+
+func ParseMetadataKeep(value string) MetadataKeep {
+	keep := MetadataKeep{}
+	for _, tag := range strings.Split(value, ",") {
+		switch strings.ToLower(strings.TrimSpace(tag)) {
+		case "orientation":
+			keep.Orientation = true
+		case "icc":
+			keep.ICC = true
+		}
+	}
+	return keep
+}
+
+var errInvalidImage = errors.New("invalid image data")
+
+// StripMetadata removes EXIF, XMP, IPTC and comments from the JPEG, PNG, WebP, HEIC, AVIF or JPEG XL file at path.
+// Other formats are left untouched.
+func StripMetadata(path string, keep MetadataKeep) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var stripped []byte
+	switch {
+	case bytes.HasPrefix(data, []byte("\xff\xd8")):
+		stripped, err = stripJpegMetadata(data, keep)
+	case bytes.HasPrefix(data, []byte("\x89PNG\r\n\x1a\n")):
+		stripped, err = stripPngMetadata(data, keep)
+	case len(data) >= 12 && bytes.HasPrefix(data, []byte("RIFF")) && string(data[8:12]) == "WEBP":
+		stripped, err = stripWebpMetadata(data, keep)
+	case len(data) >= 12 && string(data[4:8]) == "ftyp":
+		stripped, err = stripHeifMetadata(data)
+	case bytes.HasPrefix(data, jxlContainerSignature):
+		stripped, err = stripJxlMetadata(data)
+	default:
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	tempFile, err := CreatePartial(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	tempName := tempFile.Name()
+	defer os.Remove(tempName)
+
+	_, err = tempFile.Write(stripped)
+	if closeErr := tempFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	return CommitFile(tempName, path)
+}
+
+func stripJpegMetadata(data []byte, keep MetadataKeep) ([]byte, error) {
+	out := bytes.NewBuffer(make([]byte, 0, len(data)))
+	out.Write(data[:2])
+
+	orientation := 0
+	hasMpf := false
+	var kept [][]byte
+	pos := 2
+	for {
+		if pos+4 > len(data) || data[pos] != 0xff {
+			return nil, errInvalidImage
+		}
+		marker := data[pos+1]
+		if marker == 0xff {
+			pos++
+			continue
+		}
+		// Start of scan, everything after it is image data.
+		if marker == 0xda {
+			break
+		}
+		length := int(binary.BigEndian.Uint16(data[pos+2 : pos+4]))
+		end := pos + 2 + length
+		if length < 2 || end > len(data) {
+			return nil, errInvalidImage
+		}
+		segment := data[pos:end]
+		payload := segment[4:]
+
+		switch {
+		case marker == 0xe1 && bytes.HasPrefix(payload, []byte("Exif\x00\x00")):
+			if o := readExifOrientation(payload[6:]); o > 0 {
+				orientation = o
+			}
+		case marker == 0xe2 && bytes.HasPrefix(payload, []byte("ICC_PROFILE\x00")):
+			if keep.ICC {
+				kept = append(kept, segment)
+			}
+		// APP0 (JFIF) and APP14 (Adobe) describe how to decode the image and are kept.
+		case marker == 0xe0 || marker == 0xee:
+			kept = append(kept, segment)
+		case marker == 0xe2 && bytes.HasPrefix(payload, []byte("MPF\x00")):
+			hasMpf = true
+		case marker >= 0xe1 && marker <= 0xef, marker == 0xfe:
+			// Other application segments (XMP, IPTC, maker data) and comments are dropped.
+		default:
+			kept = append(kept, segment)
+		}
+		pos = end
+	}
+
+	if keep.Orientation && orientation > 1 {
+		exif := append([]byte("Exif\x00\x00"), orientationExif(orientation)...)
+		segment := []byte{0xff, 0xe1, 0, 0}
+		binary.BigEndian.PutUint16(segment[2:], uint16(len(exif)+2))
+		segment = append(segment, exif...)
+
+		// Keep the JFIF header first when there is one.
+		if len(kept) > 0 && kept[0][1] == 0xe0 {
+			kept = append(kept[:1], append([][]byte{segment}, kept[1:]...)...)
+		} else {
+			kept = append([][]byte{segment}, kept...)
+		}
+	}
+
+	for _, segment := range kept {
+		out.Write(segment)
+	}
+
+	// MPF (multi picture) files append more JPEGs after the first one, each with EXIF of its own.
+	// Without the MPF segment nothing refers to them anymore, so everything after the first image goes.
+	imageEnd := len(data)
+	if hasMpf {
+		end, err := jpegImageEnd(data, pos)
+		if err != nil {
+			return nil, err
+		}
+		imageEnd = end
+	}
+	out.Write(data[pos:imageEnd])
+	return out.Bytes(), nil
+}
+
+// jpegImageEnd returns the offset just past the EOI marker of the image whose first scan starts at pos.
+// Progressive images have several scans with table segments in between, so segments are walked
+// until EOI while skipping over the entropy coded data of every scan.
+func jpegImageEnd(data []byte, pos int) (int, error) {
+	for {
+		if pos+2 > len(data) || data[pos] != 0xff {
+			return 0, errInvalidImage
+		}
+		marker := data[pos+1]
+		switch {
+		case marker == 0xff:
+			pos++
+			continue
+		case marker == 0xd9:
+			return pos + 2, nil
+		case marker >= 0xd0 && marker <= 0xd7, marker == 0x01:
+			pos += 2
+			continue
+		}
+
+		if pos+4 > len(data) {
+			return 0, errInvalidImage
+		}
+		length := int(binary.BigEndian.Uint16(data[pos+2 : pos+4]))
+		end := pos + 2 + length
+		if length < 2 || end > len(data) {
+			return 0, errInvalidImage
+		}
+		pos = end
+		if marker != 0xda {
+			continue
+		}
+
+		// Entropy coded data ends at the first marker that isn't a stuffed 0xff00 or a restart marker.
+		for {
+			if pos+1 >= len(data) {
+				return 0, errInvalidImage
+			}
+			if data[pos] == 0xff {
+				next := data[pos+1]
+				if next != 0x00 && (next < 0xd0 || next > 0xd7) {
+					break
+				}
+			}
+			pos++
+		}
+	}
+}
+
+func stripPngMetadata(data []byte, keep MetadataKeep) ([]byte, error) {
+	out := bytes.NewBuffer(make([]byte, 0, len(data)))
+	out.Write(data[:8])
+
+	pos := 8
+	for pos < len(data) {
+		if pos+12 > len(data) {
+			return nil, errInvalidImage
+		}
+		length := int(binary.BigEndian.Uint32(data[pos : pos+4]))
+		end := pos + 12 + length
+		if length < 0 || end > len(data) {
+			return nil, errInvalidImage
+		}
+		chunkType := string(data[pos+4 : pos+8])
+
+		switch chunkType {
+		case "tEXt", "zTXt", "iTXt", "tIME":
+		case "iCCP":
+			if keep.ICC {
+				out.Write(data[pos:end])
+			}
+		case "eXIf":
+			if orientation := readExifOrientation(data[pos+8 : pos+8+length]); keep.Orientation && orientation > 1 {
+				writePngChunk(out, "eXIf", orientationExif(orientation))
+			}
+		default:
+			out.Write(data[pos:end])
+		}
+
+		pos = end
+		if chunkType == "IEND" {
+			break
+		}
+	}
+	return out.Bytes(), nil
+}
+
+func writePngChunk(out *bytes.Buffer, chunkType string, payload []byte) {
+	header := make([]byte, 8)
+	binary.BigEndian.PutUint32(header, uint32(len(payload)))
+	copy(header[4:], chunkType)
+	out.Write(header)
+	out.Write(payload)
+
+	crc := crc32.NewIEEE()
+	crc.Write(header[4:])
+	crc.Write(payload)
+	out.Write(binary.BigEndian.AppendUint32(nil, crc.Sum32()))
+}
+
+const (
+	webpFlagICC  = 0x20
+	webpFlagEXIF = 0x08
+	webpFlagXMP  = 0x04
+)
+
+func stripWebpMetadata(data []byte, keep MetadataKeep) ([]byte, error) {
+	out := bytes.NewBuffer(make([]byte, 0, len(data)))
+	out.Write(data[:12])
+
+	vp8xOffset := -1
+	flags := byte(0)
+	pos := 12
+	for pos+8 <= len(data) {
+		fourCC := string(data[pos : pos+4])
+		length := int(binary.LittleEndian.Uint32(data[pos+4 : pos+8]))
+		end := pos + 8 + length + length%2
+		if length < 0 || pos+8+length > len(data) {
+			return nil, errInvalidImage
+		}
+		end = min(end, len(data))
+
+		switch fourCC {
+		case "VP8X":
+			vp8xOffset = out.Len()
+			out.Write(data[pos:end])
+		case "ICCP":
+			if keep.ICC {
+				flags |= webpFlagICC
+				out.Write(data[pos:end])
+			}
+		case "EXIF":
+			if orientation := readExifOrientation(bytes.TrimPrefix(data[pos+8:pos+8+length], []byte("Exif\x00\x00"))); keep.Orientation && orientation > 1 {
+				flags |= webpFlagEXIF
+				exif := orientationExif(orientation)
+				out.WriteString("EXIF")
+				out.Write(binary.LittleEndian.AppendUint32(nil, uint32(len(exif))))
+				out.Write(exif)
+				if len(exif)%2 == 1 {
+					out.WriteByte(0)
+				}
+			}
+		case "XMP ":
+		default:
+			out.Write(data[pos:end])
+		}
+		pos = end
+	}
+
+	stripped := out.Bytes()
+	if vp8xOffset >= 0 && vp8xOffset+9 <= len(stripped) {
+		stripped[vp8xOffset+8] &^= webpFlagICC | webpFlagEXIF | webpFlagXMP
+		stripped[vp8xOffset+8] |= flags
+	}
+	binary.LittleEndian.PutUint32(stripped[4:8], uint32(len(stripped)-8))
+	return stripped, nil
+}
+
+// readExifOrientation returns the orientation tag of IFD0 in a TIFF structured EXIF block, or 0.
+func readExifOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 0
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 0
+	}
+
+	ifd := int(order.Uint32(tiff[4:8]))
+	if ifd+2 > len(tiff) {
+		return 0
+	}
+	entries := int(order.Uint16(tiff[ifd : ifd+2]))
+	for i := 0; i < entries; i++ {
+		entry := ifd + 2 + i*12
+		if entry+12 > len(tiff) {
+			return 0
+		}
+		if order.Uint16(tiff[entry:entry+2]) == 0x0112 {
+			return int(order.Uint16(tiff[entry+8 : entry+10]))
+		}
+	}
+	return 0
+}
+
+// orientationExif builds a TIFF structured EXIF block that only holds the orientation tag.
+func orientationExif(orientation int) []byte {
+	tiff := []byte{
+		'M', 'M', 0x00, 0x2a, 0x00, 0x00, 0x00, 0x08, // header, IFD0 at offset 8
+		0x00, 0x01, // one entry
+		0x01, 0x12, 0x00, 0x03, 0x00, 0x00, 0x00, 0x01, // orientation, SHORT, count 1
+		0x00, byte(orientation), 0x00, 0x00, // value
+		0x00, 0x00, 0x00, 0x00, // no next IFD
+	}
+	return tiff
+}
@@ -0,0 +1,344 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+// HEIC, AVIF and JPEG XL are stored in ISO base media style boxes.
+// HEIF keeps the orientation and colour profile in item properties (irot, imir, colr) and JPEG XL inside
+// its codestream, so the EXIF and XMP can go without touching what MetadataKeep asks for.
+
+var jxlContainerSignature = []byte("\x00\x00\x00\x0cJXL \x0d\x0a\x87\x0a")
+
+type isoBox struct {
+	Type    string
+	Start   int // offset of the box header
+	Payload int // offset of the box contents
+	End     int
+}
+
+// readIsoBoxes splits data[start:end] into boxes.
+func readIsoBoxes(data []byte, start int, end int) ([]isoBox, error) {
+	var boxes []isoBox
+	pos := start
+	for pos < end {
+		if pos+8 > end {
+			return nil, errInvalidImage
+		}
+		size := uint64(binary.BigEndian.Uint32(data[pos : pos+4]))
+		header := 8
+		switch size {
+		case 0:
+			size = uint64(end - pos)
+		case 1:
+			if pos+16 > end {
+				return nil, errInvalidImage
+			}
+			size = binary.BigEndian.Uint64(data[pos+8 : pos+16])
+			header = 16
+		}
+		if size < uint64(header) || size > uint64(end-pos) {
+			return nil, errInvalidImage
+		}
+
+		boxes = append(boxes, isoBox{
+			Type:    string(data[pos+4 : pos+8]),
+			Start:   pos,
+			Payload: pos + header,
+			End:     pos + int(size),
+		})
+		pos += int(size)
+	}
+	return boxes, nil
+}
+
+func findIsoBox(boxes []isoBox, boxType string) *isoBox {
+	for i := range boxes {
+		if boxes[i].Type == boxType {
+			return &boxes[i]
+		}
+	}
+	return nil
+}
+
+// stripHeifMetadata blanks the Exif and XMP items of a HEIC or AVIF file.
+// Removing items would mean rewriting every offset in the file, so their data is overwritten in place instead:
+// the Exif item becomes an empty TIFF structure and the XMP packet whitespace.
+func stripHeifMetadata(data []byte) ([]byte, error) {
+	boxes, err := readIsoBoxes(data, 0, len(data))
+	if err != nil {
+		return nil, err
+	}
+	meta := findIsoBox(boxes, "meta")
+	if meta == nil {
+		return data, nil
+	}
+
+	// meta is a full box, its children start after the version and flags.
+	children, err := readIsoBoxes(data, meta.Payload+4, meta.End)
+	if err != nil {
+		return nil, err
+	}
+	iinf := findIsoBox(children, "iinf")
+	iloc := findIsoBox(children, "iloc")
+	if iinf == nil || iloc == nil {
+		return data, nil
+	}
+
+	metadataItems, err := readHeifMetadataItems(data, iinf)
+	if err != nil {
+		return nil, err
+	}
+	if len(metadataItems) == 0 {
+		return data, nil
+	}
+
+	idatStart := -1
+	if idat := findIsoBox(children, "idat"); idat != nil {
+		idatStart = idat.Payload
+	}
+	extents, err := readHeifItemExtents(data, iloc, metadataItems, idatStart)
+	if err != nil {
+		return nil, err
+	}
+
+	stripped := bytes.Clone(data)
+	for itemId, itemExtents := range extents {
+		if metadataItems[itemId] == "Exif" {
+			blankHeifExif(stripped, itemExtents)
+			continue
+		}
+		for _, extent := range itemExtents {
+			for i := extent[0]; i < extent[1]; i++ {
+				stripped[i] = ' '
+			}
+		}
+	}
+	return stripped, nil
+}
+
+// readHeifMetadataItems returns the ids of the Exif and XMP items, with "Exif" or "XMP" as value.
+func readHeifMetadataItems(data []byte, iinf *isoBox) (map[uint32]string, error) {
+	pos := iinf.Payload
+	if pos+4 > iinf.End {
+		return nil, errInvalidImage
+	}
+	version := data[pos]
+	pos += 4
+	if version == 0 {
+		pos += 2
+	} else {
+		pos += 4
+	}
+	if pos > iinf.End {
+		return nil, errInvalidImage
+	}
+
+	entries, err := readIsoBoxes(data, pos, iinf.End)
+	if err != nil {
+		return nil, err
+	}
+
+	items := make(map[uint32]string)
+	for _, entry := range entries {
+		if entry.Type != "infe" || entry.Payload+4 > entry.End {
+			continue
+		}
+		infeVersion := data[entry.Payload]
+		// Versions 0 and 1 predate item types, they can't describe Exif or XMP items.
+		if infeVersion < 2 {
+			continue
+		}
+
+		pos := entry.Payload + 4
+		var itemId uint32
+		if infeVersion == 2 {
+			if pos+2 > entry.End {
+				return nil, errInvalidImage
+			}
+			itemId = uint32(binary.BigEndian.Uint16(data[pos : pos+2]))
+			pos += 2
+		} else {
+			if pos+4 > entry.End {
+				return nil, errInvalidImage
+			}
+			itemId = binary.BigEndian.Uint32(data[pos : pos+4])
+			pos += 4
+		}
+		// item_protection_index
+		pos += 2
+		if pos+4 > entry.End {
+			return nil, errInvalidImage
+		}
+		itemType := string(data[pos : pos+4])
+		pos += 4
+
+		switch itemType {
+		case "Exif":
+			items[itemId] = "Exif"
+		case "mime":
+			// item_name, then content_type, both null terminated.
+			rest := data[pos:entry.End]
+			_, rest, _ = bytes.Cut(rest, []byte{0})
+			contentType, _, _ := bytes.Cut(rest, []byte{0})
+			if string(contentType) == "application/rdf+xml" {
+				items[itemId] = "XMP"
+			}
+		}
+	}
+	return items, nil
+}
+
+// readHeifItemExtents returns the [start, end) byte ranges of the wanted items, read from iloc.
+func readHeifItemExtents(data []byte, iloc *isoBox, wanted map[uint32]string, idatStart int) (map[uint32][][2]int, error) {
+	pos := iloc.Payload
+	end := iloc.End
+	readUint := func(size int) (uint64, bool) {
+		if pos+size > end {
+			return 0, false
+		}
+		var value uint64
+		for _, b := range data[pos : pos+size] {
+			value = value<<8 | uint64(b)
+		}
+		pos += size
+		return value, true
+	}
+
+	if pos+6 > end {
+		return nil, errInvalidImage
+	}
+	version := data[pos]
+	pos += 4
+	offsetSize := int(data[pos] >> 4)
+	lengthSize := int(data[pos] & 0x0f)
+	baseOffsetSize := int(data[pos+1] >> 4)
+	indexSize := 0
+	if version == 1 || version == 2 {
+		indexSize = int(data[pos+1] & 0x0f)
+	}
+	pos += 2
+
+	itemCountSize := 2
+	if version == 2 {
+		itemCountSize = 4
+	}
+	itemCount, ok := readUint(itemCountSize)
+	if !ok {
+		return nil, errInvalidImage
+	}
+
+	extents := make(map[uint32][][2]int)
+	for range itemCount {
+		itemId, ok := readUint(itemCountSize)
+		if !ok {
+			return nil, errInvalidImage
+		}
+		constructionMethod := uint64(0)
+		if version == 1 || version == 2 {
+			value, ok := readUint(2)
+			if !ok {
+				return nil, errInvalidImage
+			}
+			constructionMethod = value & 0x0f
+		}
+		// data_reference_index
+		if _, ok := readUint(2); !ok {
+			return nil, errInvalidImage
+		}
+		baseOffset, ok := readUint(baseOffsetSize)
+		if !ok {
+			return nil, errInvalidImage
+		}
+		extentCount, ok := readUint(2)
+		if !ok {
+			return nil, errInvalidImage
+		}
+
+		_, isWanted := wanted[uint32(itemId)]
+		for range extentCount {
+			if _, ok := readUint(indexSize); !ok {
+				return nil, errInvalidImage
+			}
+			offset, ok := readUint(offsetSize)
+			if !ok {
+				return nil, errInvalidImage
+			}
+			length, ok := readUint(lengthSize)
+			if !ok {
+				return nil, errInvalidImage
+			}
+			if !isWanted {
+				continue
+			}
+
+			var start uint64
+			switch constructionMethod {
+			case 0:
+				start = baseOffset + offset
+			case 1:
+				if idatStart < 0 {
+					return nil, errInvalidImage
+				}
+				start = uint64(idatStart) + baseOffset + offset
+			default:
+				// Items built from other items can't be blanked without decoding them.
+				return nil, errInvalidImage
+			}
+			// A length of zero means the rest of the file.
+			stop := start + length
+			if length == 0 {
+				stop = uint64(len(data))
+			}
+			if start > stop || stop > uint64(len(data)) {
+				return nil, errInvalidImage
+			}
+			extents[uint32(itemId)] = append(extents[uint32(itemId)], [2]int{int(start), int(stop)})
+		}
+	}
+	return extents, nil
+}
+
+// blankHeifExif replaces an Exif item with an empty TIFF structure, so readers still find a valid block.
+func blankHeifExif(data []byte, extents [][2]int) {
+	var item []byte
+	for _, extent := range extents {
+		item = append(item, data[extent[0]:extent[1]]...)
+	}
+
+	// exif_tiff_header_offset, then a TIFF header whose IFD0 has no entries.
+	blank := []byte{0, 0, 0, 0, 'M', 'M', 0x00, 0x2a, 0x00, 0x00, 0x00, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}
+	for i := range item {
+		item[i] = 0
+	}
+	copy(item, blank)
+
+	for _, extent := range extents {
+		n := copy(data[extent[0]:extent[1]], item)
+		item = item[n:]
+	}
+}
+
+// stripJxlMetadata drops the Exif, XMP and JUMBF boxes of a JPEG XL container, compressed (brob) ones included.
+// A bare JPEG XL codestream has no room for metadata and is left as it is.
+func stripJxlMetadata(data []byte) ([]byte, error) {
+	boxes, err := readIsoBoxes(data, 0, len(data))
+	if err != nil {
+		return nil, err
+	}
+
+	out := bytes.NewBuffer(make([]byte, 0, len(data)))
+	for _, box := range boxes {
+		boxType := box.Type
+		if boxType == "brob" && box.Payload+4 <= box.End {
+			boxType = string(data[box.Payload : box.Payload+4])
+		}
+		switch boxType {
+		case "Exif", "xml ", "jumb":
+		default:
+			out.Write(data[box.Start:box.End])
+		}
+	}
+	return out.Bytes(), nil
+}
@@ -0,0 +1,348 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func concat(parts ...[]byte) []byte {
+	return bytes.Join(parts, nil)
+}
+
+func jpegSegment(marker byte, payload []byte) []byte {
+	segment := []byte{0xff, marker, 0, 0}
+	binary.BigEndian.PutUint16(segment[2:], uint16(len(payload)+2))
+	return append(segment, payload...)
+}
+
+// jpegScan is a scan header followed by entropy coded data with a stuffed 0xff00 and a restart marker in it.
+func jpegScan() []byte {
+	return concat(
+		jpegSegment(0xda, []byte{0x01, 0x01, 0x00, 0x00, 0x3f, 0x00}),
+		[]byte{0x12, 0xff, 0x00, 0x34, 0xff, 0xd0, 0x56},
+	)
+}
+
+var (
+	jpegSOI        = []byte{0xff, 0xd8}
+	jpegEOI        = []byte{0xff, 0xd9}
+	jpegJFIF       = jpegSegment(0xe0, []byte("JFIF\x00\x01\x01\x00\x00\x01\x00\x01\x00\x00"))
+	jpegExif       = jpegSegment(0xe1, concat([]byte("Exif\x00\x00"), orientationExif(6), []byte("GPSSECRET")))
+	jpegXMP        = jpegSegment(0xe1, []byte("http://ns.adobe.com/xap/1.0/\x00<x:xmpmeta>SECRET</x:xmpmeta>"))
+	jpegICC        = jpegSegment(0xe2, []byte("ICC_PROFILE\x00\x01\x01profile"))
+	jpegMPF        = jpegSegment(0xe2, []byte("MPF\x00MM\x00\x2a\x00\x00\x00\x08"))
+	jpegComment    = jpegSegment(0xfe, []byte("SECRET comment"))
+	jpegDQT        = jpegSegment(0xdb, bytes.Repeat([]byte{0x01}, 65))
+	jpegDHT        = jpegSegment(0xc4, bytes.Repeat([]byte{0x02}, 20))
+	jpegOrientExif = jpegSegment(0xe1, concat([]byte("Exif\x00\x00"), orientationExif(6)))
+)
+
+func TestStripJpegMetadata(t *testing.T) {
+	secondImage := concat(jpegSOI, jpegSegment(0xe1, concat([]byte("Exif\x00\x00"), orientationExif(1), []byte("GPSSECRET"))), jpegDQT, jpegScan(), jpegEOI)
+
+	tests := []struct {
+		name  string
+		input []byte
+		keep  MetadataKeep
+		want  []byte
+	}{
+		{
+			name:  "drop everything",
+			input: concat(jpegSOI, jpegJFIF, jpegExif, jpegXMP, jpegICC, jpegComment, jpegDQT, jpegScan(), jpegEOI),
+			want:  concat(jpegSOI, jpegJFIF, jpegDQT, jpegScan(), jpegEOI),
+		},
+		{
+			name:  "keep orientation and icc",
+			input: concat(jpegSOI, jpegJFIF, jpegExif, jpegXMP, jpegICC, jpegComment, jpegDQT, jpegScan(), jpegEOI),
+			keep:  MetadataKeep{Orientation: true, ICC: true},
+			want:  concat(jpegSOI, jpegJFIF, jpegOrientExif, jpegICC, jpegDQT, jpegScan(), jpegEOI),
+		},
+		{
+			name:  "orientation without jfif",
+			input: concat(jpegSOI, jpegExif, jpegDQT, jpegScan(), jpegEOI),
+			keep:  MetadataKeep{Orientation: true},
+			want:  concat(jpegSOI, jpegOrientExif, jpegDQT, jpegScan(), jpegEOI),
+		},
+		{
+			name:  "trailing data without mpf is kept",
+			input: concat(jpegSOI, jpegDQT, jpegScan(), jpegEOI, []byte("trailer")),
+			want:  concat(jpegSOI, jpegDQT, jpegScan(), jpegEOI, []byte("trailer")),
+		},
+		{
+			name:  "mpf secondary images are dropped",
+			input: concat(jpegSOI, jpegExif, jpegMPF, jpegDQT, jpegScan(), jpegEOI, secondImage),
+			keep:  MetadataKeep{Orientation: true},
+			want:  concat(jpegSOI, jpegOrientExif, jpegDQT, jpegScan(), jpegEOI),
+		},
+		{
+			name:  "mpf progressive image",
+			input: concat(jpegSOI, jpegMPF, jpegDQT, jpegDHT, jpegScan(), jpegDHT, jpegScan(), jpegEOI, secondImage),
+			want:  concat(jpegSOI, jpegDQT, jpegDHT, jpegScan(), jpegDHT, jpegScan(), jpegEOI),
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := stripJpegMetadata(test.input, test.keep)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, test.want) {
+				t.Errorf("stripJpegMetadata =\n%x\nwant\n%x", got, test.want)
+			}
+		})
+	}
+}
+
+func TestStripJpegMetadataInvalid(t *testing.T) {
+	tests := []struct {
+		name  string
+		input []byte
+	}{
+		{"truncated segment", concat(jpegSOI, jpegJFIF[:6])},
+		{"no scan", concat(jpegSOI, jpegJFIF)},
+		{"mpf without eoi", concat(jpegSOI, jpegMPF, jpegDQT, jpegScan())},
+	}
+
+	for _, test := range tests {
+		if _, err := stripJpegMetadata(test.input, MetadataKeep{}); err == nil {
+			t.Errorf("%s: stripJpegMetadata succeeded, want an error", test.name)
+		}
+	}
+}
+
+func pngChunk(chunkType string, payload []byte) []byte {
+	out := &bytes.Buffer{}
+	writePngChunk(out, chunkType, payload)
+	return out.Bytes()
+}
+
+func TestStripPngMetadata(t *testing.T) {
+	signature := []byte("\x89PNG\r\n\x1a\n")
+	ihdr := pngChunk("IHDR", []byte{0, 0, 0, 1, 0, 0, 0, 1, 8, 2, 0, 0, 0})
+	text := pngChunk("tEXt", []byte("Comment\x00SECRET"))
+	itxt := pngChunk("iTXt", []byte("XML:com.adobe.xmp\x00\x00\x00\x00\x00SECRET"))
+	iccp := pngChunk("iCCP", []byte("icc\x00\x00profile"))
+	exif := pngChunk("eXIf", concat(orientationExif(8), []byte("GPSSECRET")))
+	idat := pngChunk("IDAT", []byte("image data"))
+	iend := pngChunk("IEND", nil)
+	input := concat(signature, ihdr, text, iccp, exif, itxt, idat, iend)
+
+	tests := []struct {
+		name string
+		keep MetadataKeep
+		want []byte
+	}{
+		{"drop everything", MetadataKeep{}, concat(signature, ihdr, idat, iend)},
+		{"keep orientation", MetadataKeep{Orientation: true}, concat(signature, ihdr, pngChunk("eXIf", orientationExif(8)), idat, iend)},
+		{"keep icc", MetadataKeep{ICC: true}, concat(signature, ihdr, iccp, idat, iend)},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := stripPngMetadata(input, test.keep)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, test.want) {
+				t.Errorf("stripPngMetadata =\n%x\nwant\n%x", got, test.want)
+			}
+		})
+	}
+
+	if _, err := stripPngMetadata(concat(signature, ihdr[:10]), MetadataKeep{}); err == nil {
+		t.Error("stripPngMetadata accepted a truncated chunk")
+	}
+}
+
+func webpChunk(fourCC string, payload []byte) []byte {
+	chunk := append([]byte(fourCC), binary.LittleEndian.AppendUint32(nil, uint32(len(payload)))...)
+	chunk = append(chunk, payload...)
+	if len(payload)%2 == 1 {
+		chunk = append(chunk, 0)
+	}
+	return chunk
+}
+
+func webpFile(chunks ...[]byte) []byte {
+	body := concat(chunks...)
+	header := append([]byte("RIFF"), binary.LittleEndian.AppendUint32(nil, uint32(len(body)+4))...)
+	return concat(header, []byte("WEBP"), body)
+}
+
+func vp8x(flags byte) []byte {
+	return webpChunk("VP8X", []byte{flags, 0, 0, 0, 0, 0, 0, 0, 0, 0})
+}
+
+func TestStripWebpMetadata(t *testing.T) {
+	iccp := webpChunk("ICCP", []byte("profile"))
+	image := webpChunk("VP8 ", []byte("image data"))
+	exif := webpChunk("EXIF", concat([]byte("Exif\x00\x00"), orientationExif(3), []byte("GPSSECRET")))
+	xmp := webpChunk("XMP ", []byte("<x:xmpmeta>SECRET</x:xmpmeta>"))
+	input := webpFile(vp8x(webpFlagICC|webpFlagEXIF|webpFlagXMP), iccp, image, exif, xmp)
+
+	tests := []struct {
+		name string
+		keep MetadataKeep
+		want []byte
+	}{
+		{"drop everything", MetadataKeep{}, webpFile(vp8x(0), image)},
+		{"keep orientation", MetadataKeep{Orientation: true}, webpFile(vp8x(webpFlagEXIF), image, webpChunk("EXIF", orientationExif(3)))},
+		{"keep icc", MetadataKeep{ICC: true}, webpFile(vp8x(webpFlagICC), iccp, image)},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := stripWebpMetadata(input, test.keep)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, test.want) {
+				t.Errorf("stripWebpMetadata =\n%x\nwant\n%x", got, test.want)
+			}
+		})
+	}
+}
+
+func isoBoxBytes(boxType string, payload ...[]byte) []byte {
+	body := concat(payload...)
+	box := binary.BigEndian.AppendUint32(nil, uint32(8+len(body)))
+	box = append(box, boxType...)
+	return append(box, body...)
+}
+
+func fullBoxHeader(version byte) []byte {
+	return []byte{version, 0, 0, 0}
+}
+
+func heifInfe(itemId uint16, itemType string, contentType string) []byte {
+	payload := concat(fullBoxHeader(2), binary.BigEndian.AppendUint16(nil, itemId), []byte{0, 0}, []byte(itemType), []byte{0})
+	if contentType != "" {
+		payload = concat(payload, []byte(contentType), []byte{0})
+	}
+	return isoBoxBytes("infe", payload)
+}
+
+// heifFile builds a HEIF file with an image, an Exif and an XMP item, all stored in mdat.
+func heifFile(exif []byte, xmp []byte, image []byte) []byte {
+	ftyp := isoBoxBytes("ftyp", []byte("heic\x00\x00\x00\x00mif1heic"))
+	iinf := isoBoxBytes("iinf", fullBoxHeader(0), []byte{0, 3},
+		heifInfe(1, "hvc1", ""),
+		heifInfe(2, "Exif", ""),
+		heifInfe(3, "mime", "application/rdf+xml"),
+	)
+
+	buildMeta := func(mdatPayload int) []byte {
+		iloc := concat(fullBoxHeader(0), []byte{0x44, 0x00}, []byte{0, 3})
+		offset := mdatPayload
+		for i, item := range [][]byte{image, exif, xmp} {
+			iloc = concat(iloc, binary.BigEndian.AppendUint16(nil, uint16(i+1)), []byte{0, 0}, []byte{0, 1},
+				binary.BigEndian.AppendUint32(nil, uint32(offset)), binary.BigEndian.AppendUint32(nil, uint32(len(item))))
+			offset += len(item)
+		}
+		return isoBoxBytes("meta", fullBoxHeader(0), iinf, isoBoxBytes("iloc", iloc))
+	}
+
+	mdatPayload := len(ftyp) + len(buildMeta(0)) + 8
+	return concat(ftyp, buildMeta(mdatPayload), isoBoxBytes("mdat", image, exif, xmp))
+}
+
+func TestStripHeifMetadata(t *testing.T) {
+	image := []byte("image data")
+	exif := concat([]byte{0, 0, 0, 0}, orientationExif(6), []byte("GPSSECRET"))
+	xmp := []byte("<x:xmpmeta>SECRET</x:xmpmeta>")
+	input := heifFile(exif, xmp, image)
+
+	blankExif := make([]byte, len(exif))
+	copy(blankExif, []byte{0, 0, 0, 0, 'M', 'M', 0x00, 0x2a, 0x00, 0x00, 0x00, 0x08})
+	want := heifFile(blankExif, bytes.Repeat([]byte(" "), len(xmp)), image)
+
+	got, err := stripHeifMetadata(input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("stripHeifMetadata =\n%x\nwant\n%x", got, want)
+	}
+	if !bytes.Contains(input, []byte("SECRET")) {
+		t.Fatal("stripHeifMetadata changed its input")
+	}
+
+	if _, err := stripHeifMetadata(input[:len(input)-4]); err == nil {
+		t.Error("stripHeifMetadata accepted a truncated file")
+	}
+}
+
+func TestStripJxlMetadata(t *testing.T) {
+	signature := jxlContainerSignature
+	ftyp := isoBoxBytes("ftyp", []byte("jxl \x00\x00\x00\x00jxl "))
+	codestream := isoBoxBytes("jxlc", []byte("\xff\x0acodestream"))
+	exif := isoBoxBytes("Exif", []byte("\x00\x00\x00\x00MM\x00\x2aGPSSECRET"))
+	xmp := isoBoxBytes("xml ", []byte("<x:xmpmeta>SECRET</x:xmpmeta>"))
+	jumbf := isoBoxBytes("jumb", []byte("SECRET"))
+	compressedExif := isoBoxBytes("brob", []byte("Exif"), []byte("brotli SECRET"))
+	compressedLevel := isoBoxBytes("brob", []byte("jxll"), []byte{5})
+
+	input := concat(signature, ftyp, exif, xmp, compressedLevel, jumbf, compressedExif, codestream)
+	want := concat(signature, ftyp, compressedLevel, codestream)
+
+	got, err := stripJxlMetadata(input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("stripJxlMetadata =\n%x\nwant\n%x", got, want)
+	}
+}
+
+func TestStripMetadataFile(t *testing.T) {
+	input := concat(jpegSOI, jpegJFIF, jpegExif, jpegMPF, jpegDQT, jpegScan(), jpegEOI, jpegSOI, jpegExif, jpegScan(), jpegEOI)
+	path := filepath.Join(t.TempDir(), "image.jpg")
+	if err := os.WriteFile(path, input, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := StripMetadata(path, MetadataKeep{}); err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(got, []byte("SECRET")) {
+		t.Errorf("stripped file still contains metadata: %x", got)
+	}
+
+	// Unknown formats are left alone.
+	other := filepath.Join(t.TempDir(), "file.bin")
+	if err := os.WriteFile(other, []byte("SECRET"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := StripMetadata(other, MetadataKeep{}); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(other); string(data) != "SECRET" {
+		t.Errorf("unknown file changed to %q", data)
+	}
+}
+
+func TestParseMetadataKeep(t *testing.T) {
+	tests := []struct {
+		value string
+		want  MetadataKeep
+	}{
+		{"", MetadataKeep{}},
+		{"orientation", MetadataKeep{Orientation: true}},
+		{"orientation,icc", MetadataKeep{Orientation: true, ICC: true}},
+		{" ICC , unknown", MetadataKeep{ICC: true}},
+	}
+
+	for _, test := range tests {
+		if got := ParseMetadataKeep(test.value); got != test.want {
+			t.Errorf("ParseMetadataKeep(%q) = %+v, want %+v", test.value, got, test.want)
+		}
+	}
+}
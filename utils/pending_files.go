@@ -3,6 +3,7 @@ package utils
 import (
 	"errors"
 	"os"
+	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -27,14 +28,29 @@ type PendingFile struct {
 	Type             FileCategory
 	ImageCompressed  bool
 	MimeType         string
+	DetectedMimeType string
 	Duration         int
 	Height           int
 	Width            int
+	OriginalHeight   int
+	OriginalWidth    int
 	Animated         bool
 	FileSize         int
+	Sha256           string
+	DigestAlgorithm  string
+	Digest           string
+	ScanStatus       ScanStatus
+	CreatedAt        time.Time
 	ExpiresAt        time.Time
 }
 
+var (
+	ErrPendingFileNotFound = errors.New("File not found")
+	ErrPendingFileExpired  = errors.New("File expired")
+)
+
+// PendingFilesManager is the in-memory PendingStore. Pending files are lost on restart and only
+// the instance that received an upload can verify it.
 type PendingFilesManager struct {
 	mu    sync.RWMutex
 	store map[int64]*PendingFile
@@ -46,7 +62,7 @@ func NewPendingFilesManager() *PendingFilesManager {
 	}
 }
 
-func (m *PendingFilesManager) Add(file *PendingFile) {
+func (m *PendingFilesManager) Add(file *PendingFile) error {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
@@ -56,9 +72,13 @@ func (m *PendingFilesManager) Add(file *PendingFile) {
 	fileCopy.Filename = strings.Clone(file.Filename)
 	fileCopy.Path = strings.Clone(file.Path)
 	fileCopy.MimeType = strings.Clone(file.MimeType)
+	fileCopy.DetectedMimeType = strings.Clone(file.DetectedMimeType)
+	fileCopy.Sha256 = strings.Clone(file.Sha256)
+	fileCopy.Digest = strings.Clone(file.Digest)
 	fileCopy.Type = FileCategory(strings.Clone(string(file.Type)))
 
 	m.store[file.FileId] = &fileCopy
+	return nil
 }
 
 func (m *PendingFilesManager) Verify(fileId int64) (*PendingFile, error) {
@@ -68,17 +88,86 @@ func (m *PendingFilesManager) Verify(fileId int64) (*PendingFile, error) {
 	file, ok := m.store[fileId]
 
 	if !ok {
-		return nil, errors.New("File not found")
+		return nil, ErrPendingFileNotFound
 	}
 	delete(m.store, fileId)
 
 	if time.Now().After(file.ExpiresAt) {
-		return nil, errors.New("File expired")
+		return nil, ErrPendingFileExpired
 	}
 
 	return file, nil
 }
 
+func (m *PendingFilesManager) Remove(fileId int64) (*PendingFile, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	file, ok := m.store[fileId]
+	if !ok {
+		return nil, ErrPendingFileNotFound
+	}
+	delete(m.store, fileId)
+	return file, nil
+}
+
+func (m *PendingFilesManager) Get(fileId int64) (*PendingFile, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	file, ok := m.store[fileId]
+	if !ok {
+		return nil, ErrPendingFileNotFound
+	}
+	if time.Now().After(file.ExpiresAt) {
+		return nil, ErrPendingFileExpired
+	}
+
+	fileCopy := *file
+	return &fileCopy, nil
+}
+
+func (m *PendingFilesManager) Extend(fileId int64, expiresAt time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	file, ok := m.store[fileId]
+	if !ok || time.Now().After(file.ExpiresAt) {
+		return ErrPendingFileNotFound
+	}
+	file.ExpiresAt = expiresAt
+	return nil
+}
+
+func (m *PendingFilesManager) List(filter PendingFilter) ([]*PendingFile, PendingTotals, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var files []*PendingFile
+	totals := PendingTotals{}
+	for _, file := range m.store {
+		if !filter.Matches(file) {
+			continue
+		}
+		fileCopy := *file
+		files = append(files, &fileCopy)
+		totals.Count++
+		totals.Bytes += int64(file.FileSize)
+	}
+
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].CreatedAt.Before(files[j].CreatedAt)
+	})
+	if filter.Limit > 0 && len(files) > filter.Limit {
+		files = files[:filter.Limit]
+	}
+	return files, totals, nil
+}
+
+func (m *PendingFilesManager) Durable() bool {
+	return false
+}
+
 func (m *PendingFilesManager) StartCleanup() {
 	interval := 1 * time.Minute
 	go func() {
@@ -0,0 +1,255 @@
+package utils
+
+import (
+	"cdn_nerimity_go/database"
+	"encoding/json"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// PendingStore holds uploaded files until the server verifies them with /internal/verify-file.
+type PendingStore interface {
+	Add(file *PendingFile) error
+	// Verify removes the file from the store and returns it, a file can only be verified once.
+	Verify(fileId int64) (*PendingFile, error)
+	// Remove drops the file from the store whether it expired or not, its file in temp/ is left to the caller.
+	Remove(fileId int64) (*PendingFile, error)
+	// Get returns a copy of the file without removing it.
+	Get(fileId int64) (*PendingFile, error)
+	// Extend moves the expiry of a file that has not expired yet.
+	Extend(fileId int64, expiresAt time.Time) error
+	// List returns the oldest Limit files matching filter, expired ones that were not cleaned up yet included.
+	// The totals cover every match.
+	List(filter PendingFilter) ([]*PendingFile, PendingTotals, error)
+	// Durable reports whether pending files survive a restart, their files in temp/ must then be kept.
+	Durable() bool
+	StartCleanup()
+}
+
+// PendingFilter matches every file when left empty.
+type PendingFilter struct {
+	UserId   int64
+	GroupId  int64
+	Category FileCategory
+	Limit    int
+}
+
+func (f PendingFilter) Matches(file *PendingFile) bool {
+	return (f.UserId == 0 || file.UserId == f.UserId) &&
+		(f.GroupId == 0 || file.GroupId == f.GroupId) &&
+		(f.Category == "" || file.Type == f.Category)
+}
+
+type PendingTotals struct {
+	Count int   `json:"count"`
+	Bytes int64 `json:"bytes"`
+}
+
+func NewPendingStore(name string, databaseService *database.DatabaseService) PendingStore {
+	if name == "postgres" {
+		return NewPostgresPendingStore(databaseService)
+	}
+	return NewPendingFilesManager()
+}
+
+// Files in temp/ older than this that no pending file points at are left over from an upload
+// that failed while being processed, or from a crash. Writes still in progress are never this old.
+const pendingOrphanAge = 1 * time.Hour
+
+// PostgresPendingStore keeps pending files in the "PendingFile" table, so they survive restarts and
+// can be verified by any instance. temp/ must then be shared between the instances as well.
+type PostgresPendingStore struct {
+	database *database.DatabaseService
+}
+
+func NewPostgresPendingStore(databaseService *database.DatabaseService) *PostgresPendingStore {
+	return &PostgresPendingStore{database: databaseService}
+}
+
+func (s *PostgresPendingStore) Add(file *PendingFile) error {
+	data, err := json.Marshal(file)
+	if err != nil {
+		return err
+	}
+
+	return s.database.AddPendingFile(&database.PendingFileRecord{
+		FileId:    file.FileId,
+		UserId:    file.UserId,
+		GroupId:   file.GroupId,
+		Category:  string(file.Type),
+		Path:      file.Path,
+		Data:      data,
+		ExpiresAt: file.ExpiresAt,
+	})
+}
+
+func (s *PostgresPendingStore) Verify(fileId int64) (*PendingFile, error) {
+	record, err := s.database.TakePendingFile(fileId)
+	if err != nil {
+		return nil, err
+	}
+	if record == nil {
+		return nil, ErrPendingFileNotFound
+	}
+
+	file, err := decodePendingFile(record)
+	if err != nil {
+		return nil, err
+	}
+
+	if time.Now().After(file.ExpiresAt) {
+		return nil, ErrPendingFileExpired
+	}
+
+	return file, nil
+}
+
+func (s *PostgresPendingStore) Remove(fileId int64) (*PendingFile, error) {
+	record, err := s.database.TakePendingFile(fileId)
+	if err != nil {
+		return nil, err
+	}
+	if record == nil {
+		return nil, ErrPendingFileNotFound
+	}
+	return decodePendingFile(record)
+}
+
+func (s *PostgresPendingStore) Get(fileId int64) (*PendingFile, error) {
+	record, err := s.database.GetPendingFile(fileId)
+	if err != nil {
+		return nil, err
+	}
+	if record == nil {
+		return nil, ErrPendingFileNotFound
+	}
+
+	file, err := decodePendingFile(record)
+	if err != nil {
+		return nil, err
+	}
+
+	if time.Now().After(file.ExpiresAt) {
+		return nil, ErrPendingFileExpired
+	}
+
+	return file, nil
+}
+
+func (s *PostgresPendingStore) Extend(fileId int64, expiresAt time.Time) error {
+	extended, err := s.database.ExtendPendingFile(fileId, expiresAt)
+	if err != nil {
+		return err
+	}
+	if !extended {
+		return ErrPendingFileNotFound
+	}
+	return nil
+}
+
+func (s *PostgresPendingStore) List(filter PendingFilter) ([]*PendingFile, PendingTotals, error) {
+	dbFilter := database.PendingFileFilter{
+		UserId:   filter.UserId,
+		GroupId:  filter.GroupId,
+		Category: string(filter.Category),
+		Limit:    filter.Limit,
+	}
+
+	records, err := s.database.ListPendingFiles(dbFilter)
+	if err != nil {
+		return nil, PendingTotals{}, err
+	}
+	count, bytes, err := s.database.CountPendingFiles(dbFilter)
+	if err != nil {
+		return nil, PendingTotals{}, err
+	}
+
+	files := make([]*PendingFile, 0, len(records))
+	for _, record := range records {
+		file, err := decodePendingFile(record)
+		if err != nil {
+			return nil, PendingTotals{}, err
+		}
+		files = append(files, file)
+	}
+	return files, PendingTotals{Count: count, Bytes: bytes}, nil
+}
+
+// decodePendingFile takes the expiry from its column, Extend only updates that one.
+func decodePendingFile(record *database.PendingFileRecord) (*PendingFile, error) {
+	file := &PendingFile{}
+	err := json.Unmarshal(record.Data, file)
+	if err != nil {
+		return nil, err
+	}
+	file.ExpiresAt = record.ExpiresAt
+	return file, nil
+}
+
+func (s *PostgresPendingStore) Durable() bool {
+	return true
+}
+
+func (s *PostgresPendingStore) StartCleanup() {
+	interval := 1 * time.Minute
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			s.deleteExpired()
+			s.deleteOrphans("temp")
+		}
+	}()
+}
+
+func (s *PostgresPendingStore) deleteExpired() {
+	records, err := s.database.DeleteExpiredPendingFiles()
+	if err != nil {
+		log.Printf("Error deleting expired pending files: %v", err)
+		return
+	}
+
+	for _, record := range records {
+		os.Remove(record.Path)
+	}
+}
+
+// deleteOrphans removes the files in dir that are old enough to be left over and no pending file points at.
+func (s *PostgresPendingStore) deleteOrphans(dir string) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		log.Printf("Error reading directory: %v", err)
+		return
+	}
+
+	var paths []string
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil || time.Since(info.ModTime()) < pendingOrphanAge {
+			continue
+		}
+		// Stored the way writeTempFile names them.
+		paths = append(paths, dir+"/"+entry.Name())
+	}
+	if len(paths) == 0 {
+		return
+	}
+
+	pending, err := s.database.GetPendingFilePaths(paths)
+	if err != nil {
+		log.Printf("Error getting pending file paths: %v", err)
+		return
+	}
+
+	for _, path := range paths {
+		if !pending[path] {
+			os.Remove(filepath.FromSlash(path))
+		}
+	}
+}
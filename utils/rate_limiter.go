@@ -0,0 +1,124 @@
+package utils
+
+import (
+	"sync"
+	"time"
+)
+
+type RateLimit struct {
+	// Requests and Bytes are allowed per Window, zero disables the limit.
+	Requests int
+	Bytes    int64
+	Window   time.Duration
+	// Concurrent limits the uploads in flight at once, zero disables the limit.
+	Concurrent int
+}
+
+type rateBucket struct {
+	windowStart time.Time
+	requests    int
+	bytes       int64
+	inFlight    int
+}
+
+// RateLimiter counts requests, bytes and in-flight uploads per key using fixed windows.
+type RateLimiter struct {
+	mu      sync.Mutex
+	buckets map[string]*rateBucket
+}
+
+func NewRateLimiter() *RateLimiter {
+	return &RateLimiter{
+		buckets: make(map[string]*rateBucket),
+	}
+}
+
+// Acquire charges requests and bytes to every key and marks one upload in flight for each of them.
+// When any key is over its limit nothing is charged, and the time to wait before retrying is returned.
+// release must be called once the upload is done.
+func (l *RateLimiter) Acquire(keys []string, limit RateLimit, requests int, bytes int64) (release func(), retryAfter time.Duration, ok bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	buckets, retryAfter := l.check(keys, limit, requests, bytes)
+	if retryAfter > 0 {
+		return nil, retryAfter, false
+	}
+
+	for _, bucket := range buckets {
+		bucket.requests += requests
+		bucket.bytes += bytes
+		bucket.inFlight++
+	}
+
+	var once sync.Once
+	release = func() {
+		once.Do(func() {
+			l.mu.Lock()
+			defer l.mu.Unlock()
+			for _, bucket := range buckets {
+				bucket.inFlight--
+			}
+		})
+	}
+	return release, 0, true
+}
+
+// Check reports if Acquire would currently succeed, without charging anything.
+func (l *RateLimiter) Check(keys []string, limit RateLimit, requests int, bytes int64) (retryAfter time.Duration, ok bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	_, retryAfter = l.check(keys, limit, requests, bytes)
+	return retryAfter, retryAfter == 0
+}
+
+func (l *RateLimiter) check(keys []string, limit RateLimit, requests int, bytes int64) ([]*rateBucket, time.Duration) {
+	now := time.Now()
+	retryAfter := time.Duration(0)
+	buckets := make([]*rateBucket, len(keys))
+	for i, key := range keys {
+		bucket, exists := l.buckets[key]
+		if !exists {
+			bucket = &rateBucket{windowStart: now}
+			l.buckets[key] = bucket
+		}
+		if limit.Window > 0 && now.Sub(bucket.windowStart) >= limit.Window {
+			bucket.windowStart = now
+			bucket.requests = 0
+			bucket.bytes = 0
+		}
+		buckets[i] = bucket
+
+		windowLeft := limit.Window - now.Sub(bucket.windowStart)
+		if limit.Requests > 0 && bucket.requests+requests > limit.Requests {
+			retryAfter = max(retryAfter, windowLeft, time.Second)
+		}
+		if limit.Bytes > 0 && bucket.bytes+bytes > limit.Bytes {
+			retryAfter = max(retryAfter, windowLeft, time.Second)
+		}
+		if limit.Concurrent > 0 && bucket.inFlight >= limit.Concurrent {
+			retryAfter = max(retryAfter, time.Second)
+		}
+	}
+	return buckets, retryAfter
+}
+
+func (l *RateLimiter) StartCleanup(maxWindow time.Duration) {
+	interval := 1 * time.Minute
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			l.mu.Lock()
+			now := time.Now()
+			for key, bucket := range l.buckets {
+				if bucket.inFlight == 0 && now.Sub(bucket.windowStart) > maxWindow {
+					delete(l.buckets, key)
+				}
+			}
+			l.mu.Unlock()
+		}
+	}()
+}
@@ -0,0 +1,123 @@
+package utils
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateLimiterAcquire(t *testing.T) {
+	type step struct {
+		keys     []string
+		requests int
+		bytes    int64
+		ok       bool
+	}
+	tests := []struct {
+		name  string
+		limit RateLimit
+		steps []step
+	}{
+		{
+			name:  "requests",
+			limit: RateLimit{Requests: 2, Window: time.Minute},
+			steps: []step{
+				{keys: []string{"a"}, requests: 1, ok: true},
+				{keys: []string{"a"}, requests: 1, ok: true},
+				{keys: []string{"a"}, requests: 1, ok: false},
+				{keys: []string{"b"}, requests: 1, ok: true},
+			},
+		},
+		{
+			name:  "bytes",
+			limit: RateLimit{Bytes: 100, Window: time.Minute},
+			steps: []step{
+				{keys: []string{"a"}, requests: 1, bytes: 60, ok: true},
+				{keys: []string{"a"}, requests: 1, bytes: 60, ok: false},
+				{keys: []string{"a"}, requests: 1, bytes: 40, ok: true},
+			},
+		},
+		{
+			name:  "any key over its limit charges none",
+			limit: RateLimit{Requests: 1, Window: time.Minute},
+			steps: []step{
+				{keys: []string{"user"}, requests: 1, ok: true},
+				{keys: []string{"user", "ip"}, requests: 1, ok: false},
+				{keys: []string{"ip"}, requests: 1, ok: true},
+			},
+		},
+		{
+			name:  "zero disables",
+			limit: RateLimit{},
+			steps: []step{
+				{keys: []string{"a"}, requests: 1000, bytes: 1 << 40, ok: true},
+				{keys: []string{"a"}, requests: 1000, bytes: 1 << 40, ok: true},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			limiter := NewRateLimiter()
+			for i, step := range test.steps {
+				release, retryAfter, ok := limiter.Acquire(step.keys, test.limit, step.requests, step.bytes)
+				if ok != step.ok {
+					t.Fatalf("step %d: Acquire ok = %v, want %v", i, ok, step.ok)
+				}
+				if ok {
+					release()
+				} else if retryAfter < time.Second {
+					t.Errorf("step %d: retryAfter = %v, want at least a second", i, retryAfter)
+				}
+			}
+		})
+	}
+}
+
+func TestRateLimiterConcurrent(t *testing.T) {
+	limiter := NewRateLimiter()
+	limit := RateLimit{Concurrent: 2}
+	keys := []string{"a"}
+
+	first, _, ok := limiter.Acquire(keys, limit, 0, 0)
+	if !ok {
+		t.Fatal("first upload was limited")
+	}
+	if _, _, ok := limiter.Acquire(keys, limit, 0, 0); !ok {
+		t.Fatal("second upload was limited")
+	}
+	if _, ok := limiter.Check(keys, limit, 0, 0); ok {
+		t.Fatal("third upload was allowed while two are in flight")
+	}
+
+	// Releasing twice must not free up two slots.
+	first()
+	first()
+	if _, _, ok := limiter.Acquire(keys, limit, 0, 0); !ok {
+		t.Fatal("upload was limited after one was released")
+	}
+	if _, ok := limiter.Check(keys, limit, 0, 0); ok {
+		t.Fatal("a double release freed two slots")
+	}
+}
+
+func TestRateLimiterWindowReset(t *testing.T) {
+	limiter := NewRateLimiter()
+	limit := RateLimit{Requests: 1, Window: 50 * time.Millisecond}
+	keys := []string{"a"}
+
+	if _, _, ok := limiter.Acquire(keys, limit, 1, 0); !ok {
+		t.Fatal("first request was limited")
+	}
+	retryAfter, ok := limiter.Check(keys, limit, 1, 0)
+	if ok {
+		t.Fatal("second request in the same window was allowed")
+	}
+	if retryAfter > time.Second {
+		t.Errorf("retryAfter = %v, want at most a second", retryAfter)
+	}
+
+	time.Sleep(limit.Window)
+	if _, _, ok := limiter.Acquire(keys, limit, 1, 0); !ok {
+		t.Fatal("request after the window was limited")
+	}
+}
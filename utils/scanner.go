@@ -0,0 +1,117 @@
+package utils
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+type ScanStatus string
+
+const (
+	ScanStatusClean    ScanStatus = "clean"
+	ScanStatusInfected ScanStatus = "infected"
+	// ScanStatusUnscanned is used when the scanner failed and the upload was let through (fail-open).
+	ScanStatusUnscanned ScanStatus = "unscanned"
+)
+
+type ScanResult struct {
+	Status    ScanStatus
+	Signature string
+}
+
+// Scanner inspects uploaded files before they can be verified and served.
+type Scanner interface {
+	Scan(path string) (*ScanResult, error)
+}
+
+// NewScanner creates a scanner from an address like "unix:///run/clamav/clamd.ctl" or "tcp://127.0.0.1:3310".
+// An empty address disables scanning and returns nil.
+func NewScanner(address string) (Scanner, error) {
+	if address == "" {
+		return nil, nil
+	}
+	network, addr, ok := strings.Cut(address, "://")
+	if !ok || (network != "unix" && network != "tcp") {
+		return nil, fmt.Errorf("invalid scanner address: %s", address)
+	}
+	return &ClamdScanner{Network: network, Address: addr, Timeout: 60 * time.Second}, nil
+}
+
+// ClamdScanner streams files to clamd using the INSTREAM command.
+type ClamdScanner struct {
+	Network string
+	Address string
+	Timeout time.Duration
+}
+
+const clamdChunkSize = 64 * 1024
+
+func (s *ClamdScanner) Scan(path string) (*ScanResult, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	conn, err := net.DialTimeout(s.Network, s.Address, 5*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(s.Timeout))
+
+	if _, err := conn.Write([]byte("zINSTREAM\x00")); err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, 4+clamdChunkSize)
+	for {
+		n, readErr := file.Read(buf[4:])
+		if n > 0 {
+			binary.BigEndian.PutUint32(buf[:4], uint32(n))
+			if _, err := conn.Write(buf[:4+n]); err != nil {
+				return nil, err
+			}
+		}
+		if readErr == io.EOF {
+			break
+		}
+		if readErr != nil {
+			return nil, readErr
+		}
+	}
+
+	// A zero length chunk ends the stream.
+	if _, err := conn.Write([]byte{0, 0, 0, 0}); err != nil {
+		return nil, err
+	}
+
+	reply, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	return parseClamdReply(strings.TrimRight(reply, "\x00\n"))
+}
+
+// parseClamdReply parses "stream: OK", "stream: <signature> FOUND" or "<message> ERROR".
+func parseClamdReply(reply string) (*ScanResult, error) {
+	reply = strings.TrimPrefix(reply, "stream: ")
+
+	switch {
+	case reply == "OK":
+		return &ScanResult{Status: ScanStatusClean}, nil
+	case strings.HasSuffix(reply, " FOUND"):
+		return &ScanResult{Status: ScanStatusInfected, Signature: strings.TrimSuffix(reply, " FOUND")}, nil
+	case reply == "":
+		return nil, errors.New("clamd: empty reply")
+	default:
+		return nil, errors.New("clamd: " + reply)
+	}
+}
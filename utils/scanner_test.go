@@ -0,0 +1,212 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// fakeClamd accepts one INSTREAM scan and answers it with reply.
+// With maxLength set it answers the size limit error as soon as more than maxLength bytes arrived, like clamd's StreamMaxLength.
+type fakeClamd struct {
+	reply     string
+	maxLength int
+
+	received []byte
+	chunks   []int
+	err      error
+	done     chan struct{}
+}
+
+func startFakeClamd(t *testing.T, clamd *fakeClamd) Scanner {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	clamd.done = make(chan struct{})
+	go func() {
+		defer close(clamd.done)
+		conn, err := listener.Accept()
+		if err != nil {
+			clamd.err = err
+			return
+		}
+		defer conn.Close()
+		clamd.err = clamd.serve(conn.(*net.TCPConn))
+	}()
+
+	scanner, err := NewScanner("tcp://" + listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return scanner
+}
+
+func (f *fakeClamd) serve(conn *net.TCPConn) error {
+	command := make([]byte, len("zINSTREAM\x00"))
+	if _, err := io.ReadFull(conn, command); err != nil {
+		return err
+	}
+	if string(command) != "zINSTREAM\x00" {
+		return io.ErrUnexpectedEOF
+	}
+
+	for {
+		var header [4]byte
+		if _, err := io.ReadFull(conn, header[:]); err != nil {
+			return err
+		}
+		length := int(binary.BigEndian.Uint32(header[:]))
+		if length == 0 {
+			break
+		}
+
+		chunk := make([]byte, length)
+		if _, err := io.ReadFull(conn, chunk); err != nil {
+			return err
+		}
+		f.chunks = append(f.chunks, length)
+		f.received = append(f.received, chunk...)
+
+		if f.maxLength > 0 && len(f.received) > f.maxLength {
+			conn.Write([]byte("INSTREAM size limit exceeded. ERROR\x00"))
+			// Keep reading so the client can finish writing and get to the reply.
+			conn.CloseWrite()
+			io.Copy(io.Discard, conn)
+			return nil
+		}
+	}
+
+	_, err := conn.Write([]byte(f.reply + "\x00"))
+	return err
+}
+
+func writeScanFile(t *testing.T, size int) (string, []byte) {
+	t.Helper()
+
+	data := bytes.Repeat([]byte("0123456789abcdef"), size/16+1)[:size]
+	path := filepath.Join(t.TempDir(), "upload")
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path, data
+}
+
+func TestClamdScannerClean(t *testing.T) {
+	clamd := &fakeClamd{reply: "stream: OK"}
+	scanner := startFakeClamd(t, clamd)
+	path, data := writeScanFile(t, 3*clamdChunkSize+1000)
+
+	result, err := scanner.Scan(path)
+	<-clamd.done
+	if err != nil {
+		t.Fatalf("Scan: %v", err)
+	}
+	if clamd.err != nil {
+		t.Fatalf("fake clamd: %v", clamd.err)
+	}
+	if result.Status != ScanStatusClean {
+		t.Errorf("status = %q, want %q", result.Status, ScanStatusClean)
+	}
+
+	if !bytes.Equal(clamd.received, data) {
+		t.Errorf("clamd received %d bytes that differ from the %d byte file", len(clamd.received), len(data))
+	}
+	if len(clamd.chunks) != 4 {
+		t.Errorf("file was sent in %d chunks, want 4", len(clamd.chunks))
+	}
+	for _, chunk := range clamd.chunks {
+		if chunk > clamdChunkSize {
+			t.Errorf("chunk of %d bytes is larger than %d", chunk, clamdChunkSize)
+		}
+	}
+}
+
+func TestClamdScannerFound(t *testing.T) {
+	clamd := &fakeClamd{reply: "stream: Eicar-Test-Signature FOUND"}
+	scanner := startFakeClamd(t, clamd)
+	path, _ := writeScanFile(t, 68)
+
+	result, err := scanner.Scan(path)
+	<-clamd.done
+	if err != nil {
+		t.Fatalf("Scan: %v", err)
+	}
+	if result.Status != ScanStatusInfected {
+		t.Errorf("status = %q, want %q", result.Status, ScanStatusInfected)
+	}
+	if result.Signature != "Eicar-Test-Signature" {
+		t.Errorf("signature = %q, want %q", result.Signature, "Eicar-Test-Signature")
+	}
+}
+
+func TestClamdScannerError(t *testing.T) {
+	clamd := &fakeClamd{reply: "stream: Can't allocate memory ERROR"}
+	scanner := startFakeClamd(t, clamd)
+	path, _ := writeScanFile(t, 1000)
+
+	result, err := scanner.Scan(path)
+	<-clamd.done
+	if err == nil {
+		t.Fatalf("Scan returned %+v, want an error", result)
+	}
+	if !strings.Contains(err.Error(), "Can't allocate memory") {
+		t.Errorf("error = %q, want the clamd message", err)
+	}
+}
+
+func TestClamdScannerSizeLimit(t *testing.T) {
+	clamd := &fakeClamd{reply: "stream: OK", maxLength: clamdChunkSize}
+	scanner := startFakeClamd(t, clamd)
+	path, _ := writeScanFile(t, 4*clamdChunkSize)
+
+	result, err := scanner.Scan(path)
+	<-clamd.done
+	if err == nil {
+		t.Fatalf("Scan returned %+v, want an error", result)
+	}
+	if !strings.Contains(err.Error(), "size limit exceeded") {
+		t.Errorf("error = %q, want the size limit error", err)
+	}
+}
+
+func TestParseClamdReply(t *testing.T) {
+	tests := []struct {
+		reply     string
+		status    ScanStatus
+		signature string
+		wantErr   bool
+	}{
+		{reply: "stream: OK", status: ScanStatusClean},
+		{reply: "OK", status: ScanStatusClean},
+		{reply: "stream: Win.Test.EICAR_HDB-1 FOUND", status: ScanStatusInfected, signature: "Win.Test.EICAR_HDB-1"},
+		{reply: "INSTREAM size limit exceeded. ERROR", wantErr: true},
+		{reply: "", wantErr: true},
+	}
+
+	for _, test := range tests {
+		result, err := parseClamdReply(test.reply)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("parseClamdReply(%q) = %+v, want an error", test.reply, result)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseClamdReply(%q): %v", test.reply, err)
+			continue
+		}
+		if result.Status != test.status || result.Signature != test.signature {
+			t.Errorf("parseClamdReply(%q) = %+v, want %s %q", test.reply, result, test.status, test.signature)
+		}
+	}
+}
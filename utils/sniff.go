@@ -0,0 +1,175 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+)
+
+const sniffLength = 512
+
+type fileSignature struct {
+	Offset int
+	Magic  []byte
+	Mime   string
+}
+
+// Checked in order, so the more specific signatures come first.
+var fileSignatures = []fileSignature{
+	{0, []byte("\x89PNG\r\n\x1a\n"), "image/png"},
+	{0, []byte("\xff\xd8\xff"), "image/jpeg"},
+	{0, []byte("GIF87a"), "image/gif"},
+	{0, []byte("GIF89a"), "image/gif"},
+	{8, []byte("WEBP"), "image/webp"},
+	{8, []byte("WAVE"), "audio/wav"},
+	{0, []byte("\x1a\x45\xdf\xa3"), "video/webm"},
+	{0, []byte("OggS"), "audio/ogg"},
+	{0, []byte("ID3"), "audio/mpeg"},
+	{0, []byte("\xff\x0a"), "image/jxl"},
+	{0, []byte("\x00\x00\x00\x0cJXL \x0d\x0a\x87\x0a"), "image/jxl"},
+	{4, []byte("ftyp"), "video/mp4"},
+}
+
+// ISO base media files all start with an ftyp box, the major brand tells HEIF and AVIF images apart from MP4 videos.
+// Files with the generic mif1 or msf1 major brand name the actual codec in their compatible brands.
+func detectFtypBrand(header []byte) string {
+	if len(header) < 12 {
+		return "video/mp4"
+	}
+	major := string(header[8:12])
+	if major == "mif1" || major == "msf1" {
+		end := min(int(binary.BigEndian.Uint32(header[0:4])), len(header))
+		for pos := 16; pos+4 <= end; pos += 4 {
+			if mime := heifBrandMime(string(header[pos : pos+4])); mime != "" {
+				return mime
+			}
+		}
+		return "image/heif"
+	}
+	if mime := heifBrandMime(major); mime != "" {
+		return mime
+	}
+	return "video/mp4"
+}
+
+func heifBrandMime(brand string) string {
+	switch brand {
+	case "avif", "avis":
+		return "image/avif"
+	case "heic", "heix", "heim", "heis", "hevc", "hevx":
+		return "image/heic"
+	}
+	return ""
+}
+
+// isMpegAudioFrame reports if header starts with an MPEG audio frame without an ID3 tag in front of it.
+// The frame header is an 11 bit sync followed by the version, layer, bitrate and sample rate, of which
+// the reserved values are rejected so that random data starting with 0xff isn't taken for audio.
+func isMpegAudioFrame(header []byte) bool {
+	if len(header) < 3 || header[0] != 0xff || header[1]&0xe0 != 0xe0 {
+		return false
+	}
+	version := header[1] >> 3 & 0x03
+	layer := header[1] >> 1 & 0x03
+	bitrate := header[2] >> 4
+	sampleRate := header[2] >> 2 & 0x03
+	return version != 0x01 && layer != 0x00 && bitrate != 0x0f && sampleRate != 0x03
+}
+
+// DetectMimeType reads the first bytes of the file and returns the mime type of its real contents,
+// ignoring the file name and whatever the client claimed.
+func DetectMimeType(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	header := make([]byte, sniffLength)
+	n, err := io.ReadFull(file, header)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return "", err
+	}
+	header = header[:n]
+
+	for _, signature := range fileSignatures {
+		end := signature.Offset + len(signature.Magic)
+		if len(header) >= end && bytes.Equal(header[signature.Offset:end], signature.Magic) {
+			if signature.Mime == "image/webp" || signature.Mime == "audio/wav" {
+				// WEBP and WAVE are both RIFF containers.
+				if !bytes.HasPrefix(header, []byte("RIFF")) {
+					continue
+				}
+			}
+			if signature.Mime == "video/mp4" {
+				return detectFtypBrand(header), nil
+			}
+			return signature.Mime, nil
+		}
+	}
+
+	if isMpegAudioFrame(header) {
+		return "audio/mpeg", nil
+	}
+
+	mime := http.DetectContentType(header)
+	mime, _, _ = strings.Cut(mime, ";")
+	return mime, nil
+}
+
+// MimeMatchesExtension reports if the detected mime type is allowed to be stored with the given extension.
+// Extensions that are not images or media can hold anything, they are served as downloads.
+func MimeMatchesExtension(mime string, ext string) bool {
+	switch strings.ToLower(ext) {
+	case ".png":
+		return mime == "image/png"
+	case ".jpg", ".jpeg":
+		return mime == "image/jpeg"
+	case ".gif":
+		return mime == "image/gif"
+	case ".webp":
+		return mime == "image/webp"
+	case ".heic", ".heif":
+		return mime == "image/heic" || mime == "image/heif"
+	case ".avif":
+		return mime == "image/avif"
+	case ".jxl":
+		return mime == "image/jxl"
+	case ".mp4":
+		return mime == "video/mp4"
+	case ".webm":
+		return mime == "video/webm"
+	case ".ogg":
+		return mime == "audio/ogg"
+	case ".mp3":
+		return mime == "audio/mpeg"
+	case ".wav":
+		return mime == "audio/wav"
+	default:
+		return true
+	}
+}
+
+var mimeExtensions = map[string]string{
+	"image/png":  ".png",
+	"image/jpeg": ".jpg",
+	"image/gif":  ".gif",
+	"image/webp": ".webp",
+	"image/heic": ".heic",
+	"image/heif": ".heif",
+	"image/avif": ".avif",
+	"image/jxl":  ".jxl",
+	"video/mp4":  ".mp4",
+	"video/webm": ".webm",
+	"audio/ogg":  ".ogg",
+	"audio/mpeg": ".mp3",
+	"audio/wav":  ".wav",
+}
+
+// ExtensionForMimeType returns the extension files of the given type are stored with, or "" when there is none.
+func ExtensionForMimeType(mime string) string {
+	return mimeExtensions[mime]
+}
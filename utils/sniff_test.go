@@ -0,0 +1,131 @@
+package utils
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// ftypBox builds an ftyp box with the given major and compatible brands.
+func ftypBox(major string, compatible ...string) []byte {
+	box := make([]byte, 16, 16+4*len(compatible))
+	binary.BigEndian.PutUint32(box[0:4], uint32(16+4*len(compatible)))
+	copy(box[4:8], "ftyp")
+	copy(box[8:12], major)
+	for _, brand := range compatible {
+		box = append(box, brand...)
+	}
+	return box
+}
+
+func TestDetectMimeType(t *testing.T) {
+	tests := []struct {
+		name   string
+		header []byte
+		mime   string
+	}{
+		{"png", []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\x0dIHDR"), "image/png"},
+		{"jpeg", []byte("\xff\xd8\xff\xe0\x00\x10JFIF\x00"), "image/jpeg"},
+		{"gif", []byte("GIF89a\x01\x00\x01\x00"), "image/gif"},
+		{"webp", []byte("RIFF\x24\x00\x00\x00WEBPVP8 "), "image/webp"},
+		{"wav", []byte("RIFF\x24\x00\x00\x00WAVEfmt "), "audio/wav"},
+		{"webp without riff", []byte("XXXX\x24\x00\x00\x00WEBPVP8 "), "application/octet-stream"},
+		{"webm", []byte("\x1a\x45\xdf\xa3\x9f\x42\x86\x81"), "video/webm"},
+		{"ogg", []byte("OggS\x00\x02\x00\x00"), "audio/ogg"},
+		{"mp3 with id3", []byte("ID3\x04\x00\x00\x00\x00\x00\x00"), "audio/mpeg"},
+		{"mp3 mpeg1 layer3", []byte("\xff\xfb\x90\x64"), "audio/mpeg"},
+		{"mp3 mpeg1 layer3 without crc", []byte("\xff\xfa\x90\x64"), "audio/mpeg"},
+		{"mp3 mpeg2 layer3", []byte("\xff\xf3\x48\xc4"), "audio/mpeg"},
+		{"mp3 mpeg2.5 layer3", []byte("\xff\xe3\x18\xc4"), "audio/mpeg"},
+		{"mp3 mpeg1 layer2", []byte("\xff\xfd\x90\x64"), "audio/mpeg"},
+		{"jxl codestream", []byte("\xff\x0a\xfa\x7f"), "image/jxl"},
+		{"jxl container", []byte("\x00\x00\x00\x0cJXL \x0d\x0a\x87\x0a"), "image/jxl"},
+		{"mp4", ftypBox("isom", "isom", "iso2", "mp41"), "video/mp4"},
+		{"avif", ftypBox("avif", "mif1", "miaf"), "image/avif"},
+		{"avif sequence", ftypBox("avis", "msf1", "avif"), "image/avif"},
+		{"heic", ftypBox("heic", "mif1", "heic"), "image/heic"},
+		{"mif1 with avif", ftypBox("mif1", "mif1", "avif", "miaf"), "image/avif"},
+		{"msf1 with avis", ftypBox("msf1", "msf1", "avis"), "image/avif"},
+		{"mif1 with heic", ftypBox("mif1", "mif1", "heic"), "image/heic"},
+		{"mif1 only", ftypBox("mif1", "mif1", "miaf"), "image/heif"},
+		{"text", []byte("hello world"), "text/plain"},
+	}
+
+	dir := t.TempDir()
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(dir, "file")
+			if err := os.WriteFile(path, test.header, 0644); err != nil {
+				t.Fatal(err)
+			}
+			mime, err := DetectMimeType(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if mime != test.mime {
+				t.Errorf("DetectMimeType = %q, want %q", mime, test.mime)
+			}
+		})
+	}
+}
+
+func TestIsMpegAudioFrame(t *testing.T) {
+	tests := []struct {
+		name   string
+		header []byte
+		frame  bool
+	}{
+		{"mpeg1 layer3", []byte("\xff\xfb\x90\x64"), true},
+		{"mpeg2 layer2", []byte("\xff\xf5\x48\xc4"), true},
+		{"mpeg2.5 layer1", []byte("\xff\xe7\x18\xc4"), true},
+		{"aac adts", []byte("\xff\xf1\x50\x80"), false},
+		{"reserved version", []byte("\xff\xeb\x90\x64"), false},
+		{"free bitrate", []byte("\xff\xfb\x00\x64"), true},
+		{"bad bitrate", []byte("\xff\xfb\xf0\x64"), false},
+		{"reserved sample rate", []byte("\xff\xfb\x9c\x64"), false},
+		{"jpeg", []byte("\xff\xd8\xff\xe0"), false},
+		{"jxl codestream", []byte("\xff\x0a\xfa\x7f"), false},
+		{"too short", []byte("\xff\xfb"), false},
+	}
+
+	for _, test := range tests {
+		if frame := isMpegAudioFrame(test.header); frame != test.frame {
+			t.Errorf("%s: isMpegAudioFrame = %v, want %v", test.name, frame, test.frame)
+		}
+	}
+}
+
+func TestDetectFtypBrandIgnoresBrandsPastTheBox(t *testing.T) {
+	// The brands of the next box must not be read as compatible brands.
+	header := append(ftypBox("mif1", "miaf"), "\x00\x00\x00\x0cavif"...)
+	if mime := detectFtypBrand(header); mime != "image/heif" {
+		t.Errorf("detectFtypBrand = %q, want image/heif", mime)
+	}
+}
+
+func TestMimeMatchesExtension(t *testing.T) {
+	tests := []struct {
+		mime  string
+		ext   string
+		match bool
+	}{
+		{"image/png", ".png", true},
+		{"image/png", ".PNG", true},
+		{"image/jpeg", ".png", false},
+		{"image/jpeg", ".jpeg", true},
+		{"image/heif", ".heic", true},
+		{"image/heic", ".heif", true},
+		{"image/avif", ".avif", true},
+		{"image/heif", ".avif", false},
+		{"audio/mpeg", ".mp3", true},
+		{"video/mp4", ".mp3", false},
+		{"application/x-msdownload", ".exe", true},
+	}
+
+	for _, test := range tests {
+		if match := MimeMatchesExtension(test.mime, test.ext); match != test.match {
+			t.Errorf("MimeMatchesExtension(%q, %q) = %v, want %v", test.mime, test.ext, match, test.match)
+		}
+	}
+}
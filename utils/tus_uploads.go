@@ -0,0 +1,137 @@
+package utils
+
+import (
+	"errors"
+	"os"
+	"sync"
+	"time"
+)
+
+const TusUploadExpiry = 1 * time.Hour
+
+type TusUpload struct {
+	UploadId  int64
+	UserId    int64
+	GroupId   int64
+	Filename  string
+	MimeType  string
+	Path      string
+	Length    int64
+	Offset    int64
+	FileId    int64
+	ExpiresAt time.Time
+	busy      bool
+}
+
+type TusUploadsManager struct {
+	mu    sync.Mutex
+	store map[int64]*TusUpload
+}
+
+func NewTusUploadsManager() *TusUploadsManager {
+	return &TusUploadsManager{
+		store: make(map[int64]*TusUpload),
+	}
+}
+
+func (m *TusUploadsManager) Add(upload *TusUpload) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	uploadCopy := *upload
+	m.store[upload.UploadId] = &uploadCopy
+}
+
+// Get returns a copy of the upload so callers can read it without holding the lock.
+func (m *TusUploadsManager) Get(uploadId int64) (*TusUpload, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	upload, ok := m.store[uploadId]
+	if !ok || time.Now().After(upload.ExpiresAt) {
+		return nil, errors.New("Upload not found")
+	}
+
+	uploadCopy := *upload
+	return &uploadCopy, nil
+}
+
+// Acquire marks the upload as busy so only one PATCH request can append to it at a time.
+func (m *TusUploadsManager) Acquire(uploadId int64) (*TusUpload, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	upload, ok := m.store[uploadId]
+	if !ok || time.Now().After(upload.ExpiresAt) {
+		return nil, errors.New("Upload not found")
+	}
+	if upload.busy {
+		return nil, errors.New("Upload is locked")
+	}
+	upload.busy = true
+
+	uploadCopy := *upload
+	return &uploadCopy, nil
+}
+
+// Release stores the new offset (and file id once finished) and unlocks the upload.
+func (m *TusUploadsManager) Release(upload *TusUpload) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	stored, ok := m.store[upload.UploadId]
+	if !ok {
+		return
+	}
+	stored.Offset = upload.Offset
+	stored.Path = upload.Path
+	stored.FileId = upload.FileId
+	stored.busy = false
+}
+
+func (m *TusUploadsManager) Remove(uploadId int64) (*TusUpload, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	upload, ok := m.store[uploadId]
+	if !ok {
+		return nil, errors.New("Upload not found")
+	}
+	if upload.busy {
+		return nil, errors.New("Upload is locked")
+	}
+	delete(m.store, uploadId)
+
+	return upload, nil
+}
+
+// Discard drops the upload even while it is busy, used when finishing it failed.
+func (m *TusUploadsManager) Discard(uploadId int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.store, uploadId)
+}
+
+func (m *TusUploadsManager) StartCleanup() {
+	interval := 1 * time.Minute
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			m.mu.Lock()
+			now := time.Now()
+			for id, upload := range m.store {
+				if now.After(upload.ExpiresAt) && !upload.busy {
+					// Finished uploads have been handed over to the pending files manager.
+					if upload.FileId == 0 {
+						os.Remove(upload.Path)
+					}
+					delete(m.store, id)
+				}
+			}
+			m.mu.Unlock()
+		}
+	}()
+}
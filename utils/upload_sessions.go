@@ -0,0 +1,77 @@
+package utils
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+const UploadSessionExpiry = 10 * time.Minute
+
+// UploadSession is what a client declared in POST /uploads/init before sending the file.
+type UploadSession struct {
+	UploadId  int64
+	UserId    string
+	Category  FileCategory
+	GroupId   string
+	Filename  string
+	Size      int64
+	MimeType  string
+	Sha256    string
+	ExpiresAt time.Time
+}
+
+type UploadSessionsManager struct {
+	mu    sync.Mutex
+	store map[int64]*UploadSession
+}
+
+func NewUploadSessionsManager() *UploadSessionsManager {
+	return &UploadSessionsManager{
+		store: make(map[int64]*UploadSession),
+	}
+}
+
+func (m *UploadSessionsManager) Add(session *UploadSession) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	sessionCopy := *session
+	m.store[session.UploadId] = &sessionCopy
+}
+
+// Take removes the session, a session can only be used for one upload.
+func (m *UploadSessionsManager) Take(uploadId int64) (*UploadSession, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	session, ok := m.store[uploadId]
+	if !ok {
+		return nil, errors.New("Upload session not found")
+	}
+	delete(m.store, uploadId)
+
+	if time.Now().After(session.ExpiresAt) {
+		return nil, errors.New("Upload session expired")
+	}
+	return session, nil
+}
+
+func (m *UploadSessionsManager) StartCleanup() {
+	interval := 1 * time.Minute
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			m.mu.Lock()
+			now := time.Now()
+			for id, session := range m.store {
+				if now.After(session.ExpiresAt) {
+					delete(m.store, id)
+				}
+			}
+			m.mu.Unlock()
+		}
+	}()
+}
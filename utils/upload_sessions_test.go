@@ -0,0 +1,34 @@
+package utils
+
+import (
+	"testing"
+	"time"
+)
+
+func TestUploadSessionsTake(t *testing.T) {
+	m := NewUploadSessionsManager()
+	m.Add(&UploadSession{UploadId: 1, ExpiresAt: time.Now().Add(time.Minute)})
+	m.Add(&UploadSession{UploadId: 2, ExpiresAt: time.Now().Add(-time.Second)})
+
+	tests := []struct {
+		name     string
+		uploadId int64
+		ok       bool
+	}{
+		{"valid", 1, true},
+		{"already taken", 1, false},
+		{"expired", 2, false},
+		{"expired sessions are removed too", 2, false},
+		{"unknown", 3, false},
+	}
+
+	for _, test := range tests {
+		session, err := m.Take(test.uploadId)
+		if test.ok && (err != nil || session.UploadId != test.uploadId) {
+			t.Errorf("%s: Take = %+v, %v", test.name, session, err)
+		}
+		if !test.ok && err == nil {
+			t.Errorf("%s: Take = %+v, want an error", test.name, session)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package utils
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+var ErrUploadStalled = errors.New("Upload stalled")
+
+// StalledUploads counts the uploads aborted by an UploadWatchdog since the server started.
+var StalledUploads atomic.Int64
+
+// UploadWatchdog aborts a request body that arrives slower than MinBytesPerSecond, measured over Window.
+// A client that stops sending altogether is caught by moving the read deadline of the connection
+// forward on every read, so a single Read can't block for longer than Window.
+type UploadWatchdog struct {
+	src               io.Reader
+	conn              net.Conn
+	minBytesPerSecond int64
+	window            time.Duration
+
+	windowStart time.Time
+	windowBytes int64
+	// Total is the number of bytes read so far.
+	Total int64
+}
+
+// NewUploadWatchdog wraps src, the body of a request on conn. conn may be nil, then only the rate is checked.
+// A zero minBytesPerSecond or window disables the watchdog.
+func NewUploadWatchdog(src io.Reader, conn net.Conn, minBytesPerSecond int64, window time.Duration) *UploadWatchdog {
+	return &UploadWatchdog{
+		src:               src,
+		conn:              conn,
+		minBytesPerSecond: minBytesPerSecond,
+		window:            window,
+		windowStart:       time.Now(),
+	}
+}
+
+func (w *UploadWatchdog) Read(p []byte) (int, error) {
+	if w.minBytesPerSecond <= 0 || w.window <= 0 {
+		n, err := w.src.Read(p)
+		w.Total += int64(n)
+		return n, err
+	}
+
+	readStart := time.Now()
+	if w.conn != nil {
+		w.conn.SetReadDeadline(readStart.Add(w.window))
+	}
+	n, err := w.src.Read(p)
+	w.Total += int64(n)
+	w.windowBytes += int64(n)
+
+	// Chunked bodies don't always pass the deadline error through, so check how long the read took as well.
+	if err != nil && err != io.EOF && (errors.Is(err, os.ErrDeadlineExceeded) || time.Since(readStart) >= w.window) {
+		return n, w.stalled()
+	}
+
+	elapsed := time.Since(w.windowStart)
+	if elapsed >= w.window {
+		if float64(w.windowBytes)/elapsed.Seconds() < float64(w.minBytesPerSecond) {
+			return n, w.stalled()
+		}
+		w.windowStart = time.Now()
+		w.windowBytes = 0
+	}
+	return n, err
+}
+
+func (w *UploadWatchdog) stalled() error {
+	StalledUploads.Add(1)
+	return ErrUploadStalled
+}
@@ -1,8 +1,13 @@
 package utils
 
 import (
+	"context"
 	"fmt"
+	"os"
 	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
 )
 
 func GenerateThumbnail(videoPath string, outputPath string) (string, error) {
@@ -22,3 +27,62 @@ func GenerateThumbnail(videoPath string, outputPath string) (string, error) {
 
 	return outputPath, nil
 }
+
+// remuxFormats maps the video extensions RemuxVideo handles to their ffmpeg muxer.
+var remuxFormats = map[string]string{
+	".mp4":  "mp4",
+	".webm": "webm",
+}
+
+func CanRemuxVideo(path string) bool {
+	_, ok := remuxFormats[strings.ToLower(filepath.Ext(path))]
+	return ok
+}
+
+// RemuxVideo rewrites the container of an MP4 or WebM file without re-encoding it.
+// Global and stream metadata (location, device, creation time) and chapters are dropped,
+// and MP4s get their moov atom moved to the front so playback can start before the whole file is fetched.
+// The file at path is only replaced when ffmpeg succeeds within timeout.
+func RemuxVideo(path string, timeout time.Duration) error {
+	format, ok := remuxFormats[strings.ToLower(filepath.Ext(path))]
+	if !ok {
+		return nil
+	}
+
+	tempFile, err := CreatePartial(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	tempName := tempFile.Name()
+	tempFile.Close()
+	defer os.Remove(tempName)
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), timeout)
+	defer cancelFn()
+
+	args := []string{
+		"-v", "error",
+		"-i", path,
+		// Only audio and video are kept, data and subtitle tracks can't always be copied into the same container.
+		"-map", "0:v?",
+		"-map", "0:a?",
+		"-c", "copy",
+		"-map_metadata", "-1",
+		"-map_chapters", "-1",
+		"-fflags", "+bitexact",
+	}
+	if format == "mp4" {
+		args = append(args, "-movflags", "+faststart")
+	}
+	args = append(args, "-f", format, "-y", tempName)
+
+	output, err := exec.CommandContext(ctx, "ffmpeg", args...).CombinedOutput()
+	if ctx.Err() != nil {
+		return fmt.Errorf("ffmpeg timed out after %s", timeout)
+	}
+	if err != nil {
+		return fmt.Errorf("ffmpeg failed: %w: %s", err, strings.TrimSpace(string(output)))
+	}
+
+	return CommitFile(tempName, path)
+}
@@ -0,0 +1,234 @@
+//go:build !novips
+
+package utils
+
+import (
+	"math"
+
+	"github.com/cshum/vipsgen/vips"
+	"github.com/gofiber/fiber/v3"
+)
+
+// Everything that needs libvips (and cgo) lives here. Building with -tags novips replaces it with
+// vips_disabled.go, so the rest of the package can be built and tested without libvips installed.
+
+func StartupVips() {
+	vips.Startup(nil)
+}
+
+func ShutdownVips() {
+	vips.Shutdown()
+}
+
+// ProbeImage reads the dimensions and frame count of an image.
+// libvips only parses the header here, pixels are not decoded until they are used.
+func ProbeImage(path string) (*ImageHeader, error) {
+	image, err := vips.NewImageFromFile(path, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer image.Close()
+
+	header := &ImageHeader{
+		Width:  image.Width(),
+		Height: image.PageHeight(),
+		Frames: max(image.Pages(), 1),
+	}
+	if isRotatedOrientation(appliedOrientation(image)) {
+		header.Width, header.Height = header.Height, header.Width
+	}
+	return header, nil
+}
+
+// appliedOrientation is the EXIF orientation normalizeImage applies to image, 1 when it leaves it as it is.
+// Animated images are loaded as one tall strip of frames, rotating it would mix up the frames.
+func appliedOrientation(image *vips.Image) int {
+	if image.Pages() > 1 {
+		return 1
+	}
+	return image.Orientation()
+}
+
+// VipsImageProcessor does the same work as imgproxy in process, using the linked libvips.
+type VipsImageProcessor struct {
+	Limits ImageLimits
+}
+
+func (p *VipsImageProcessor) Compress(opts ImageProxyOptions, outputPath string) error {
+	image, err := loadImage(opts.Path, opts.Static)
+	if err != nil {
+		return err
+	}
+	defer image.Close()
+
+	err = normalizeImage(image)
+	if err != nil {
+		return err
+	}
+
+	// Like imgproxy, crop points are relative to the upright image and applied before resizing.
+	if opts.Crop != nil {
+		err = cropImage(image, opts.Crop.X, opts.Crop.Y, opts.Crop.Width, opts.Crop.Height)
+		if err != nil {
+			return err
+		}
+	}
+
+	if opts.Size.ResizeType == ResizeTypeFill {
+		err = fillImage(image, opts.Size)
+	} else {
+		err = fitImage(image, opts.Size.Width, opts.Size.Height)
+	}
+	if err != nil {
+		return err
+	}
+
+	return image.Webpsave(outputPath, vips.DefaultWebpsaveOptions())
+}
+
+func (p *VipsImageProcessor) ServeLocal(c fiber.Ctx, opts BasicImageProxyOptions) error {
+	header, err := ProbeImage(opts.URL)
+	if err != nil {
+		return SendError(c, fiber.StatusUnsupportedMediaType, "Invalid image")
+	}
+	// Only the first frame is decoded for static images.
+	if opts.Static {
+		header.Frames = 1
+	}
+	if err := p.Limits.Check(header); err != nil {
+		return SendError(c, fiber.StatusUnprocessableEntity, err.Error())
+	}
+
+	image, err := loadImage(opts.URL, opts.Static)
+	if err != nil {
+		return SendError(c, fiber.StatusUnsupportedMediaType, "Invalid image")
+	}
+	defer image.Close()
+
+	err = normalizeImage(image)
+	if err != nil {
+		return SendError(c, fiber.StatusInternalServerError, "Failed to process image")
+	}
+
+	if opts.Size != 0 {
+		err = fitImage(image, opts.Size, opts.Size)
+		if err != nil {
+			return SendError(c, fiber.StatusInternalServerError, "Failed to resize image")
+		}
+	}
+
+	buf, err := image.WebpsaveBuffer(vips.DefaultWebpsaveBufferOptions())
+	if err != nil {
+		return SendError(c, fiber.StatusInternalServerError, "Failed to encode image")
+	}
+
+	c.Type("webp")
+	return c.Send(buf)
+}
+
+// loadImage loads every frame of an animated image, or only the first one when static is set.
+func loadImage(path string, static bool) (*vips.Image, error) {
+	opts := vips.DefaultLoadOptions()
+	opts.N = -1
+	if static {
+		opts.N = 1
+	}
+	return vips.NewImageFromFile(path, opts)
+}
+
+// normalizeImage applies the EXIF orientation and converts the colours to sRGB, like imgproxy does with ar and scp.
+// WebP output drops the orientation tag and most viewers ignore other colour profiles, so both are baked into the pixels.
+func normalizeImage(image *vips.Image) error {
+	if appliedOrientation(image) > 1 {
+		err := image.Autorot(nil)
+		if err != nil {
+			return err
+		}
+	}
+
+	if image.HasICCProfile() {
+		opts := vips.DefaultIccTransformOptions()
+		opts.Embedded = true
+		return image.IccTransform("srgb", opts)
+	}
+	if image.Interpretation() == vips.InterpretationCmyk {
+		return image.Colourspace(vips.InterpretationSrgb, nil)
+	}
+	return nil
+}
+
+func cropImage(image *vips.Image, x int, y int, width int, height int) error {
+	frameWidth := image.Width()
+	frameHeight := image.PageHeight()
+
+	x = min(max(x, 0), frameWidth-1)
+	y = min(max(y, 0), frameHeight-1)
+	width = min(width, frameWidth-x)
+	height = min(height, frameHeight-y)
+	if width <= 0 || height <= 0 {
+		return nil
+	}
+
+	return image.ExtractAreaMultiPage(x, y, width, height)
+}
+
+// fitImage downscales the image to fit inside width x height, keeping the aspect ratio.
+func fitImage(image *vips.Image, width int, height int) error {
+	frameWidth := image.Width()
+	frameHeight := image.PageHeight()
+
+	scale := math.Min(1.0, math.Min(float64(width)/float64(frameWidth), float64(height)/float64(frameHeight)))
+	return scaleImage(image, scale)
+}
+
+// fillImage crops the centre of the image to the aspect ratio of size, then downscales it to fit size.
+func fillImage(image *vips.Image, size ImageProxySize) error {
+	frameWidth := image.Width()
+	frameHeight := image.PageHeight()
+	aspectRatio := float64(size.Width) / float64(size.Height)
+
+	targetDims := calculateTargetDimensions(
+		calculateTargetDimensionsOptions{
+			OriginalDimensions: Dimensions{Width: frameWidth, Height: frameHeight},
+			MaxDimensions:      Dimensions{Width: size.Width, Height: size.Height},
+			AspectRatio:        aspectRatio,
+		},
+	)
+
+	cropWidth := frameWidth
+	cropHeight := int(math.Round(float64(frameWidth) / aspectRatio))
+	if float64(frameWidth)/float64(frameHeight) > aspectRatio {
+		cropHeight = frameHeight
+		cropWidth = int(math.Round(float64(frameHeight) * aspectRatio))
+	}
+
+	err := cropImage(image, (frameWidth-cropWidth)/2, (frameHeight-cropHeight)/2, cropWidth, cropHeight)
+	if err != nil {
+		return err
+	}
+
+	return scaleImage(image, float64(targetDims.Width)/float64(image.Width()))
+}
+
+// scaleImage resizes every frame by scale, keeping the page height of animated images in step.
+func scaleImage(image *vips.Image, scale float64) error {
+	if scale >= 1.0 {
+		return nil
+	}
+
+	pages := image.Height() / image.PageHeight()
+	pageHeight := max(1, int(math.Round(float64(image.PageHeight())*scale)))
+
+	opts := vips.DefaultResizeOptions()
+	opts.Vscale = float64(pageHeight*pages) / float64(image.Height())
+
+	err := image.Resize(scale, opts)
+	if err != nil {
+		return err
+	}
+
+	if pages > 1 {
+		return image.SetPageHeight(pageHeight)
+	}
+	return nil
+}
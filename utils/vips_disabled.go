@@ -0,0 +1,34 @@
+//go:build novips
+
+package utils
+
+import (
+	"errors"
+
+	"github.com/gofiber/fiber/v3"
+)
+
+// Stands in for vips.go when building with -tags novips. Images can't be probed or processed in process,
+// only the imgproxy ImageProcessor works.
+
+var errVipsDisabled = errors.New("built without libvips")
+
+func StartupVips() {}
+
+func ShutdownVips() {}
+
+func ProbeImage(path string) (*ImageHeader, error) {
+	return nil, errVipsDisabled
+}
+
+type VipsImageProcessor struct {
+	Limits ImageLimits
+}
+
+func (p *VipsImageProcessor) Compress(opts ImageProxyOptions, outputPath string) error {
+	return errVipsDisabled
+}
+
+func (p *VipsImageProcessor) ServeLocal(c fiber.Ctx, opts BasicImageProxyOptions) error {
+	return SendError(c, fiber.StatusNotImplemented, errVipsDisabled.Error())
+}